@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// arbitration holds the cross-journey priorities of the loaded rules file; Release applies them before every send
+var arbitration Arbitration
+
+// Arbitration lets the highest priority journey win when several message the same user within a cycle
+type Arbitration struct {
+	Cycle    string   `yaml:"cycle" json:"cycle"`       // Go duration, e.g. "24h"; arbitration is off when empty
+	Priority []string `yaml:"priority" json:"priority"` // Events from highest to lowest priority; unlisted events come last
+
+	cycle time.Duration
+	rank  map[string]int
+}
+
+// resolve parses the cycle and indexes the priority order
+func (a *Arbitration) resolve() error {
+	if a.Cycle == "" {
+		return nil
+	}
+	var err error
+	if a.cycle, err = time.ParseDuration(a.Cycle); err != nil || a.cycle <= 0 {
+		return fmt.Errorf("invalid arbitration cycle %q", a.Cycle)
+	}
+	a.rank = make(map[string]int, len(a.Priority))
+	for i, event := range a.Priority {
+		if _, exists := a.rank[event]; exists {
+			return fmt.Errorf("event %s is listed twice in the arbitration priority", event)
+		}
+		a.rank[event] = i
+	}
+	return nil
+}
+
+// rankOf returns the position of an event in the priority order, lower winning
+func (a *Arbitration) rankOf(event string) int {
+	if rank, ok := a.rank[event]; ok {
+		return rank
+	}
+	return len(a.Priority)
+}
+
+// arbitrate decides whether a claimed notification may be sent and returns the event it loses to, if any: another
+// event of equal or higher priority sent to the user within the last cycle, or another event queued for the user
+// within the next cycle with higher priority, or with equal priority and due earlier. A strictly higher priority
+// event is sent even after a lower priority message this cycle, and further attempts of the same event are left to
+// their attempt ladder and min_spacing
+func arbitrate(db *gorm.DB, job notificationJob, notification Notification) (string, error) {
+	if arbitration.cycle == 0 {
+		return "", nil
+	}
+	now := time.Now()
+	var sent []string
+	err := db.Raw(`SELECT DISTINCT event_name FROM notification_status
+		WHERE user_id = ? AND status = ? AND sent_at >= ? AND event_name <> ?`,
+		notification.UserID, deliverySent, now.Add(-arbitration.cycle), notification.Event).Scan(&sent).Error
+	if err != nil {
+		log.Printf("Error arbitrating %s for user_id %d: %v", notification.Event, notification.UserID, err)
+		return "", fmt.Errorf("error arbitrating %s for user_id %d: %v", notification.Event, notification.UserID, err)
+	}
+	rank := arbitration.rankOf(notification.Event)
+	for _, event := range sent {
+		if arbitration.rankOf(event) <= rank {
+			return event, nil
+		}
+	}
+
+	var queued []struct {
+		ID          int64
+		EventName   string
+		ScheduledAt time.Time
+	}
+	err = db.Raw(`SELECT id, event_name, scheduled_at FROM notification_jobs
+		WHERE user_id = ? AND id <> ? AND state IN (?, ?) AND event_name <> ? AND scheduled_at < ?`,
+		notification.UserID, job.ID, jobPending, jobProcessing, notification.Event, now.Add(arbitration.cycle)).Scan(&queued).Error
+	if err != nil {
+		log.Printf("Error arbitrating %s for user_id %d: %v", notification.Event, notification.UserID, err)
+		return "", fmt.Errorf("error arbitrating %s for user_id %d: %v", notification.Event, notification.UserID, err)
+	}
+	for _, other := range queued {
+		otherRank := arbitration.rankOf(other.EventName)
+		if otherRank < rank {
+			return other.EventName, nil
+		}
+		// Ties go to the job due first, so two jobs released at once do not both send
+		if otherRank == rank && (other.ScheduledAt.Before(job.ScheduledAt) || other.ScheduledAt.Equal(job.ScheduledAt) && other.ID < job.ID) {
+			return other.EventName, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArbitrateByPriority(t *testing.T) {
+	db := testDB(t)
+	if err := db.Exec(`CREATE TABLE notification_status (user_id BIGINT, event_name TEXT, status TEXT, sent_at TIMESTAMPTZ);
+		CREATE TABLE notification_jobs (id BIGSERIAL PRIMARY KEY, user_id BIGINT, event_name TEXT, state TEXT, scheduled_at TIMESTAMPTZ)`).Error; err != nil {
+		t.Fatal(err)
+	}
+	previous := arbitration
+	defer func() { arbitration = previous }()
+	arbitration = Arbitration{Cycle: "24h", Priority: []string{"CREDIT_CARD_REJECTED", "VKYC_DROPOFF", "PAN_FORM_DROPOFF", "AADHAR_FORM_DROPOFF"}}
+	if err := arbitration.resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	sentAt := time.Now().Add(-time.Hour)
+	if err := db.Exec(`INSERT INTO notification_status (user_id, event_name, status, sent_at) VALUES (1, 'VKYC_DROPOFF', ?, ?), (1, 'AADHAR_FORM_DROPOFF', ?, ?)`,
+		deliverySent, sentAt, deliverySent, sentAt.Add(-48*time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO notification_jobs (user_id, event_name, state, scheduled_at) VALUES (3, 'CREDIT_CARD_REJECTED', ?, ?)`,
+		jobPending, time.Now().Add(time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		userID     uint32
+		event      string
+		wantWinner string
+	}{
+		{"lower priority after a sent nudge", 1, "PAN_FORM_DROPOFF", "VKYC_DROPOFF"},
+		{"next attempt of the same event", 1, "VKYC_DROPOFF", ""},
+		{"higher priority after a sent nudge", 1, "CREDIT_CARD_REJECTED", ""},
+		{"higher priority queued within the cycle", 3, "PAN_FORM_DROPOFF", "CREDIT_CARD_REJECTED"},
+		{"user without messages this cycle", 2, "PAN_FORM_DROPOFF", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := notificationJob{ID: 100, ScheduledAt: time.Now()}
+			winner, err := arbitrate(db, job, Notification{UserID: tt.userID, Event: tt.event})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if winner != tt.wantWinner {
+				t.Errorf("arbitrate = %q, want %q", winner, tt.wantWinner)
+			}
+		})
+	}
+}
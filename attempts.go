@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// attemptLimits holds the attempt limits of the loaded rules file
+var attemptLimits AttemptLimits
+
+// AttemptLimits bound the notification_config attempt ladder of every event
+type AttemptLimits struct {
+	Default AttemptLimit            `yaml:"default" json:"default"`
+	Events  map[string]AttemptLimit `yaml:"events" json:"events"` // Replace the default for an event
+}
+
+// AttemptLimit is the attempt ladder bound of one event
+type AttemptLimit struct {
+	MaxAttempts int    `yaml:"max_attempts" json:"max_attempts"` // Attempts sent before the user is exhausted; 0 leaves it to notification_config
+	MinSpacing  string `yaml:"min_spacing" json:"min_spacing"`   // Go duration between two sent attempts, e.g. "12h"
+
+	minSpacing time.Duration
+}
+
+// resolve validates the default and every event limit
+func (a *AttemptLimits) resolve() error {
+	if err := a.Default.resolve(); err != nil {
+		return fmt.Errorf("default attempt limit: %v", err)
+	}
+	for event, limit := range a.Events {
+		if err := limit.resolve(); err != nil {
+			return fmt.Errorf("attempt limit for event %s: %v", event, err)
+		}
+		a.Events[event] = limit
+	}
+	return nil
+}
+
+// resolve parses the minimum spacing
+func (l *AttemptLimit) resolve() error {
+	if l.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must not be negative")
+	}
+	if l.MinSpacing == "" {
+		return nil
+	}
+	var err error
+	if l.minSpacing, err = time.ParseDuration(l.MinSpacing); err != nil || l.minSpacing < 0 {
+		return fmt.Errorf("invalid min_spacing %q", l.MinSpacing)
+	}
+	return nil
+}
+
+// forEvent returns the limit of an event
+func (a AttemptLimits) forEvent(event string) AttemptLimit {
+	if limit, ok := a.Events[event]; ok {
+		return limit
+	}
+	return a.Default
+}
+
+// exhausted reports whether no attempt may follow the given one
+func (l AttemptLimit) exhausted(attempt int) bool {
+	return l.MaxAttempts > 0 && attempt >= l.MaxAttempts
+}
+
+// spaced moves a notification that would follow the previous sent attempt too closely to lastSent + MinSpacing,
+// then into its send window
+func (l AttemptLimit) spaced(notification Notification, lastSent time.Time) Notification {
+	earliest := lastSent.Add(l.minSpacing)
+	if l.minSpacing == 0 || lastSent.IsZero() || !notification.ScheduledAt.Before(earliest) {
+		return notification
+	}
+	scheduledAt := sendWindows.windowFor(notification.Channel, notification.Event).next(earliest)
+	log.Printf("Spacing attempt %d for user_id %d, event %s: %s -> %s (min_spacing %s)", notification.Attempt, notification.UserID,
+		notification.Event, notification.ScheduledAt.Format(time.RFC3339), scheduledAt.Format(time.RFC3339), l.MinSpacing)
+	notification.ScheduledAt = scheduledAt
+	notification.Delay = time.Until(scheduledAt).Seconds()
+	return notification
+}
+
+// reportExhausted logs the users who were sent every attempt of an event since the given time without converting,
+// i.e. without reaching a status that would now supersede the event. Events without such statuses (failures and
+// the Go journeys) cannot convert and are always listed
+func reportExhausted(db *gorm.DB, since time.Time, logger *log.Logger) error {
+	var rows []struct {
+		UserID       uint32
+		EventName    string
+		Attempt      int
+		AnchorAt     *time.Time
+		UpdatedAt    time.Time
+		MobileNumber string
+	}
+	err := db.Raw(`SELECT ns.user_id, ns.event_name, ns.attempt, ns.anchor_at, ns.updated_at, u.mobile_number
+		FROM notification_status ns
+		JOIN users u ON u.id = ns.user_id
+		WHERE ns.status = ? AND ns.updated_at >= ?
+		ORDER BY ns.event_name, ns.updated_at`, deliveryExhausted, since).Scan(&rows).Error
+	if err != nil {
+		log.Printf("Error fetching exhausted notifications: %v", err)
+		return fmt.Errorf("error fetching exhausted notifications: %v", err)
+	}
+
+	// Rows are ordered by event, so the per-event summary is too
+	var events []string
+	counts := make(map[string]int)
+	notConverted := 0
+	for _, row := range rows {
+		notification := Notification{UserID: row.UserID, Event: row.EventName, Mobile: row.MobileNumber}
+		if row.AnchorAt != nil {
+			notification.AnchorAt = *row.AnchorAt
+		}
+		converted, err := supersededBy(db, notification)
+		if err != nil {
+			return err
+		}
+		if converted != "" {
+			continue
+		}
+		if counts[row.EventName] == 0 {
+			events = append(events, row.EventName)
+		}
+		counts[row.EventName]++
+		notConverted++
+		logger.Printf("Exhausted without converting: user_id=%d, event=%s, attempts=%d, exhausted_at=%s",
+			row.UserID, row.EventName, row.Attempt, row.UpdatedAt.Format(time.RFC3339))
+	}
+	for _, event := range events {
+		logger.Printf("Exhausted without converting for event %s: users=%d", event, counts[event])
+	}
+	logger.Printf("Exhausted users since %s: total=%d, not converted=%d", since.Format(time.RFC3339), len(rows), notConverted)
+	return nil
+}
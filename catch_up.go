@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Catch-up policies for notifications whose scheduled time has already passed (notification_config.catch_up_policy)
+const (
+	catchUpDrop     = "drop"     // Skip the notification
+	catchUpGrace    = "grace"    // Send immediately if at most catch_up_grace_seconds late, otherwise skip
+	catchUpReanchor = "reanchor" // Move to the next daily occurrence of the scheduled time
+)
+
+// Catch-up decisions recorded in the run report
+const (
+	decisionDropped    = "dropped"
+	decisionGraceSent  = "sent_within_grace"
+	decisionPastGrace  = "dropped_past_grace"
+	decisionReanchored = "reanchored"
+)
+
+// catchUp decides what to do with a past-due notification, returning the new scheduled time and whether to keep it
+func catchUp(config NotificationConfigDetails, scheduled, now time.Time) (time.Time, string, bool) {
+	switch config.CatchUpPolicy {
+	case catchUpGrace:
+		if now.Sub(scheduled) <= time.Duration(config.CatchUpGraceSeconds)*time.Second {
+			return now, decisionGraceSent, true
+		}
+		return scheduled, decisionPastGrace, false
+	case catchUpReanchor:
+		days := int(now.Sub(scheduled)/(24*time.Hour)) + 1
+		return scheduled.AddDate(0, 0, days), decisionReanchored, true
+	default:
+		return scheduled, decisionDropped, false
+	}
+}
+
+// validCatchUpPolicy reports whether a notification_config.catch_up_policy value is known
+func validCatchUpPolicy(policy string) bool {
+	switch policy {
+	case "", catchUpDrop, catchUpGrace, catchUpReanchor:
+		return true
+	}
+	return false
+}
+
+// runReport collects per-event outcomes of a run that are not delivery results
+type runReport struct {
+	mu      sync.Mutex
+	catchUp map[string]map[string]int // Event -> catch-up decision -> count
+}
+
+// newRunReport creates an empty run report
+func newRunReport() *runReport {
+	return &runReport{catchUp: make(map[string]map[string]int)}
+}
+
+// addCatchUp records a catch-up decision for a past-due notification
+func (r *runReport) addCatchUp(event, decision string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.catchUp[event] == nil {
+		r.catchUp[event] = make(map[string]int)
+	}
+	r.catchUp[event][decision]++
+}
+
+// log writes the catch-up decisions per event
+func (r *runReport) log(logger *log.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]string, 0, len(r.catchUp))
+	for event := range r.catchUp {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		var counts []string
+		for _, decision := range []string{decisionDropped, decisionGraceSent, decisionPastGrace, decisionReanchored} {
+			if n := r.catchUp[event][decision]; n > 0 {
+				counts = append(counts, fmt.Sprintf("%s=%d", decision, n))
+			}
+		}
+		logger.Printf("Past-due notifications for event %s: %s", event, strings.Join(counts, ", "))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestCatchUpPolicies(t *testing.T) {
+	now := time.Date(2026, 3, 2, 12, 0, 0, 0, istLocation)
+	tests := []struct {
+		name         string
+		config       NotificationConfigDetails
+		scheduled    time.Time
+		want         time.Time
+		wantDecision string
+		wantKeep     bool
+	}{
+		{"grace, late within the limit", NotificationConfigDetails{CatchUpPolicy: catchUpGrace, CatchUpGraceSeconds: 3600}, now.Add(-30 * time.Minute), now, decisionGraceSent, true},
+		{"grace, late by exactly the limit", NotificationConfigDetails{CatchUpPolicy: catchUpGrace, CatchUpGraceSeconds: 3600}, now.Add(-time.Hour), now, decisionGraceSent, true},
+		{"grace, late past the limit", NotificationConfigDetails{CatchUpPolicy: catchUpGrace, CatchUpGraceSeconds: 3600}, now.Add(-2 * time.Hour), now.Add(-2 * time.Hour), decisionPastGrace, false},
+		{"grace without a limit", NotificationConfigDetails{CatchUpPolicy: catchUpGrace}, now.Add(-time.Second), now.Add(-time.Second), decisionPastGrace, false},
+		{"reanchor, late by hours", NotificationConfigDetails{CatchUpPolicy: catchUpReanchor}, now.Add(-3 * time.Hour), now.Add(21 * time.Hour), decisionReanchored, true},
+		{"reanchor, late by days", NotificationConfigDetails{CatchUpPolicy: catchUpReanchor}, now.Add(-30 * time.Hour), now.Add(18 * time.Hour), decisionReanchored, true},
+		{"drop", NotificationConfigDetails{CatchUpPolicy: catchUpDrop}, now.Add(-time.Minute), now.Add(-time.Minute), decisionDropped, false},
+		{"no policy drops", NotificationConfigDetails{}, now.Add(-time.Minute), now.Add(-time.Minute), decisionDropped, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, decision, keep := catchUp(tt.config, tt.scheduled, now)
+			if !got.Equal(tt.want) || decision != tt.wantDecision || keep != tt.wantKeep {
+				t.Errorf("catchUp = %s, %s, %t; want %s, %s, %t", got, decision, keep, tt.want, tt.wantDecision, tt.wantKeep)
+			}
+		})
+	}
+}
+
+func TestBuildNotificationPastDue(t *testing.T) {
+	sendWindows = SendWindows{}
+	defer func() { sendWindows = SendWindows{} }()
+
+	user := UserDetails{ID: 42, FullName: "Asha", PlainMobileNumber: "9800000042"}
+	// Due an hour ago: anchored 7 hours ago with a 6 hour delay
+	candidate := Candidate{MobileNumber: "9800000042", EventType: "PAN_FORM_DROPOFF", AnchorAt: time.Now().Add(-7 * time.Hour)}
+	due := candidate.AnchorAt.Add(6 * time.Hour)
+	tests := []struct {
+		policy       string
+		grace        int
+		want         time.Time
+		wantDecision string
+	}{
+		{catchUpGrace, 7200, time.Now(), decisionGraceSent},
+		{catchUpGrace, 600, time.Time{}, decisionPastGrace},
+		{catchUpReanchor, 0, due.AddDate(0, 0, 1), decisionReanchored},
+		{catchUpDrop, 0, time.Time{}, decisionDropped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantDecision, func(t *testing.T) {
+			config := NotificationConfigDetails{EventName: "PAN_FORM_DROPOFF", Channel: "push", Delay: 6 * 3600, CatchUpPolicy: tt.policy, CatchUpGraceSeconds: tt.grace}
+			notification, decision := buildNotification(candidate, user, CustomHeaderDetails{}, config, 1, "test")
+			if decision != tt.wantDecision {
+				t.Errorf("decision = %s, want %s", decision, tt.wantDecision)
+			}
+			if tt.want.IsZero() {
+				if notification.Event != "" {
+					t.Errorf("dropped notification was built: %+v", notification)
+				}
+				return
+			}
+			if notification.Event != "PAN_FORM_DROPOFF" || notification.ScheduledAt.Sub(tt.want).Abs() > time.Minute {
+				t.Errorf("notification %s scheduled at %s, want about %s", notification.Event, notification.ScheduledAt, tt.want)
+			}
+		})
+	}
+
+	// On time notifications have no catch-up decision
+	config := NotificationConfigDetails{EventName: "PAN_FORM_DROPOFF", Channel: "push", Delay: 8 * 3600}
+	if notification, decision := buildNotification(candidate, user, CustomHeaderDetails{}, config, 1, "test"); decision != "" || !notification.ScheduledAt.Equal(candidate.AnchorAt.Add(8*time.Hour)) {
+		t.Errorf("on time notification: decision %q, scheduled at %s", decision, notification.ScheduledAt)
+	}
+}
+
+func TestValidCatchUpPolicy(t *testing.T) {
+	for _, policy := range []string{"", catchUpDrop, catchUpGrace, catchUpReanchor} {
+		if !validCatchUpPolicy(policy) {
+			t.Errorf("validCatchUpPolicy(%q) = false", policy)
+		}
+	}
+	if validCatchUpPolicy("send_now") {
+		t.Error(`validCatchUpPolicy("send_now") = true`)
+	}
+}
+
+func TestRunReportLogsDecisionsPerEvent(t *testing.T) {
+	report := newRunReport()
+	report.addCatchUp("VKYC_DROPOFF", decisionDropped)
+	report.addCatchUp("PAN_FORM_DROPOFF", decisionGraceSent)
+	report.addCatchUp("PAN_FORM_DROPOFF", decisionPastGrace)
+	report.addCatchUp("PAN_FORM_DROPOFF", decisionGraceSent)
+
+	var out bytes.Buffer
+	report.log(log.New(&out, "", 0))
+	want := "Past-due notifications for event PAN_FORM_DROPOFF: sent_within_grace=2, dropped_past_grace=1\n" +
+		"Past-due notifications for event VKYC_DROPOFF: dropped=1\n"
+	if out.String() != want {
+		t.Errorf("report =\n%s\nwant\n%s", out.String(), want)
+	}
+}
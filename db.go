@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/joho/godotenv"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// loadEnv loads variables from a .env file when present
+func loadEnv() {
+	err := godotenv.Load()
+	if err != nil {
+		log.Printf("No .env file found, relying on system environment variables")
+	}
+}
+
+// connectDB establishes a connection to the PostgreSQL database
+func connectDB() (*gorm.DB, error) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return nil, fmt.Errorf("DATABASE_URL must be set in environment variables")
+	}
+
+	config := &gorm.Config{}
+	if os.Getenv("LOG_QUERIES") == "true" {
+		config.Logger = logger.Default.LogMode(logger.Info) // Enable query logging
+	}
+
+	db, err := gorm.Open(postgres.Open(dbURL), config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	// One pool is shared by every journey scan and delivery worker
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database pool: %v", err)
+	}
+	maxOpenConns := intFromEnv("DB_MAX_OPEN_CONNS", 10)
+	sqlDB.SetMaxOpenConns(maxOpenConns)
+	sqlDB.SetMaxIdleConns(maxOpenConns)
+
+	return db, nil
+}
+
+// lookbackDaysFromEnv returns the configurable lookback period in days (default 7 days)
+func lookbackDaysFromEnv() int {
+	days := 7
+	if value := os.Getenv("LOOKBACK_DAYS"); value != "" {
+		if n, err := fmt.Sscanf(value, "%d", &days); err != nil || n != 1 {
+			log.Printf("Invalid LOOKBACK_DAYS=%s, using default 7 days", value)
+			days = 7
+		}
+	}
+	return days
+}
+
+// intFromEnv reads a positive integer setting, falling back to def when unset or invalid
+func intFromEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s=%s, using default %d", name, value, def)
+		return def
+	}
+	return n
+}
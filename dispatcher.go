@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Delivery outcomes recorded in DeliveryResult.Status
+const (
+	deliverySent       = "sent"
+	deliveryFailed     = "failed"
+	deliverySuperseded = "superseded" // Cancelled before sending because the user moved on in the journey
+	deliverySuppressed = "suppressed" // Cancelled before sending because another journey's message won arbitration
+	deliveryCapped     = "capped"     // Cancelled before sending by a frequency cap with the drop policy
+	deliveryDeferred   = "deferred"   // Held back by a frequency cap until Notification.ScheduledAt; not recorded
+	deliveryExhausted  = "exhausted"  // Terminal: the notification was the last attempt of its event for the user
+)
+
+// errNotApplicable is returned by senders used as sinks when they have nothing to do for a notification
+var errNotApplicable = errors.New("not applicable")
+
+// Sender delivers notifications over one channel
+type Sender interface {
+	// Name identifies the sender (provider) in logs and results
+	Name() string
+	// Send delivers the notification and returns the provider message id, if any
+	Send(ctx context.Context, notification Notification) (string, error)
+}
+
+// DeliveryResult is the outcome of dispatching a single notification
+type DeliveryResult struct {
+	Notification Notification
+	Sender       string
+	MessageID    string
+	Status       string
+	Err          error
+	SupersededBy string // Status that made a superseded notification stale, event that suppressed it or cap that dropped it
+	RecordErr    error  // Set when the result could not be persisted
+}
+
+// deliveryRecorder persists delivery results, e.g. to notification_status
+type deliveryRecorder interface {
+	Record(result DeliveryResult) error
+}
+
+// Dispatcher hands notifications to the sender registered for their channel
+type Dispatcher struct {
+	senders  map[string]Sender
+	dryRun   Sender           // When set, used for every channel instead of the registered senders
+	recorder deliveryRecorder // Persists sent, failed and cancelled results when set
+	logger   *log.Logger
+
+	sinks           []*mirrorQueue // Receive a copy of every sent notification; failures are only logged
+	mirrorQueueSize int            // Notifications waiting per sink before further copies are dropped
+	mirrorWorkers   int            // Copies handed to each sink concurrently
+	mirrorsMu       sync.RWMutex   // Guards mirrorsClosed against mirror calls racing waitForMirrors
+	mirrorsClosed   bool
+	mirrorsRunning  sync.WaitGroup // Sink workers still draining their queue
+	mirrorsDropped  atomic.Int64   // Copies dropped because a sink's queue was full
+}
+
+// mirrorQueue is a sink with its bounded queue of notifications to mirror
+type mirrorQueue struct {
+	sink          Sender
+	notifications chan Notification
+}
+
+// newDispatcher creates a dispatcher without senders; each sink gets a queue of MIRROR_QUEUE_SIZE notifications
+// (default 1000) drained by MIRROR_WORKERS workers (default 4)
+func newDispatcher(logger *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		senders:         make(map[string]Sender),
+		logger:          logger,
+		mirrorQueueSize: intFromEnv("MIRROR_QUEUE_SIZE", 1000),
+		mirrorWorkers:   intFromEnv("MIRROR_WORKERS", 4),
+	}
+}
+
+// normalizeChannel maps notification_config.channel values to sender keys
+func normalizeChannel(channel string) string {
+	return strings.ToLower(strings.TrimSpace(channel))
+}
+
+// Register sets the sender used for a channel
+func (d *Dispatcher) Register(channel string, sender Sender) {
+	d.senders[normalizeChannel(channel)] = sender
+	d.logger.Printf("Registered sender %s for channel %s", sender.Name(), normalizeChannel(channel))
+}
+
+// AddSink mirrors every successfully sent notification to the sender, through a bounded queue drained in the
+// background
+func (d *Dispatcher) AddSink(sink Sender) {
+	queue := &mirrorQueue{sink: sink, notifications: make(chan Notification, d.mirrorQueueSize)}
+	d.sinks = append(d.sinks, queue)
+	for i := 0; i < d.mirrorWorkers; i++ {
+		d.mirrorsRunning.Add(1)
+		go func() {
+			defer d.mirrorsRunning.Done()
+			for notification := range queue.notifications {
+				// Mirrors are not cancelled on shutdown; waitForMirrors lets the queue drain
+				if _, err := sink.Send(context.Background(), notification); err != nil && !errors.Is(err, errNotApplicable) {
+					d.logger.Printf("Error mirroring %s for user_id %d to %s: %v", notification.Event, notification.UserID, sink.Name(), err)
+				}
+			}
+		}()
+	}
+	d.logger.Printf("Registered sink %s", sink.Name())
+}
+
+// SetRecorder persists every sent or failed result right after delivery
+func (d *Dispatcher) SetRecorder(recorder deliveryRecorder) {
+	d.recorder = recorder
+}
+
+// SetDryRun routes every channel to the given sender
+func (d *Dispatcher) SetDryRun(sender Sender) {
+	d.dryRun = sender
+}
+
+// senderFor returns the sender for a channel, or nil when none is registered
+func (d *Dispatcher) senderFor(channel string) Sender {
+	if d.dryRun != nil {
+		return d.dryRun
+	}
+	return d.senders[normalizeChannel(channel)]
+}
+
+// deliver sends a due notification through its channel's sender, mirrors and records the result
+func (d *Dispatcher) deliver(ctx context.Context, notification Notification) DeliveryResult {
+	result := DeliveryResult{Notification: notification}
+	sender := d.senderFor(notification.Channel)
+	if sender == nil {
+		result.Status = deliveryFailed
+		result.Err = fmt.Errorf("no sender registered for channel %q", notification.Channel)
+		d.logger.Printf("Failed notification for user_id %d, event %s: %v", notification.UserID, notification.Event, result.Err)
+		d.record(&result)
+		return result
+	}
+
+	result.Sender = sender.Name()
+	messageID, err := sender.Send(ctx, notification)
+	if err != nil {
+		result.Status = deliveryFailed
+		result.Err = fmt.Errorf("error sending %s to user_id %d via %s: %w", notification.Event, notification.UserID, sender.Name(), err)
+		d.logger.Printf("Failed notification: %v", result.Err)
+	} else {
+		result.Status = deliverySent
+		result.MessageID = messageID
+		d.logger.Printf("Sent notification for user_id %d, event %s, attempt %d via %s: message_id=%s",
+			notification.UserID, notification.Event, notification.Attempt, sender.Name(), messageID)
+		d.mirror(sender, notification)
+	}
+	d.record(&result)
+	return result
+}
+
+// cancel records a notification as superseded or suppressed by cause (a journey status or a winning event)
+// instead of sending it
+func (d *Dispatcher) cancel(notification Notification, status, cause string) DeliveryResult {
+	result := DeliveryResult{Notification: notification, Status: status, SupersededBy: cause}
+	d.logger.Printf("Cancelled notification for user_id %d, event %s, attempt %d: %s by %s",
+		notification.UserID, notification.Event, notification.Attempt, status, cause)
+	d.record(&result)
+	return result
+}
+
+// exhaust records that the user has been sent the last attempt of the notification's event
+func (d *Dispatcher) exhaust(notification Notification) DeliveryResult {
+	result := DeliveryResult{Notification: notification, Status: deliveryExhausted}
+	d.logger.Printf("Exhausted attempts for user_id %d, event %s after attempt %d",
+		notification.UserID, notification.Event, notification.Attempt)
+	d.record(&result)
+	return result
+}
+
+// deferUntil holds a capped notification back until the cap's period ends
+func (d *Dispatcher) deferUntil(notification Notification, until time.Time, cause string) DeliveryResult {
+	notification.ScheduledAt = until
+	d.logger.Printf("Deferred notification for user_id %d, event %s, attempt %d until %s: %s",
+		notification.UserID, notification.Event, notification.Attempt, until.Format(time.RFC3339), cause)
+	return DeliveryResult{Notification: notification, Status: deliveryDeferred, SupersededBy: cause}
+}
+
+// record persists the result unless this is a dry run
+func (d *Dispatcher) record(result *DeliveryResult) {
+	if d.recorder == nil || d.dryRun != nil {
+		return
+	}
+	result.RecordErr = d.recorder.Record(*result)
+}
+
+// mirror queues a sent notification for the sinks, skipping the sender that already delivered it, so a slow sink
+// (e.g. a webhook endpoint retrying with backoff) does not hold up the next delivery. A copy is dropped and counted
+// when the sink's queue is full
+func (d *Dispatcher) mirror(sentBy Sender, notification Notification) {
+	d.mirrorsMu.RLock()
+	defer d.mirrorsMu.RUnlock()
+	if d.mirrorsClosed {
+		return
+	}
+	for _, queue := range d.sinks {
+		if queue.sink == sentBy {
+			continue
+		}
+		select {
+		case queue.notifications <- notification:
+		default:
+			dropped := d.mirrorsDropped.Add(1)
+			d.logger.Printf("Mirror queue of %s is full, dropping %s for user_id %d (dropped=%d)",
+				queue.sink.Name(), notification.Event, notification.UserID, dropped)
+		}
+	}
+}
+
+// waitForMirrors stops accepting mirror copies and blocks until every queued one has been handed to its sink
+func (d *Dispatcher) waitForMirrors() {
+	d.mirrorsMu.Lock()
+	if !d.mirrorsClosed {
+		d.mirrorsClosed = true
+		for _, queue := range d.sinks {
+			close(queue.notifications)
+		}
+	}
+	d.mirrorsMu.Unlock()
+	d.mirrorsRunning.Wait()
+	if dropped := d.mirrorsDropped.Load(); dropped > 0 {
+		d.logger.Printf("Dropped %d mirror copies because a sink's queue was full", dropped)
+	}
+}
+
+// logSummary logs the number of results per delivery status
+func (d *Dispatcher) logSummary(results []DeliveryResult) {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	d.logger.Printf("Dispatched notifications: total=%d, sent=%d, failed=%d, superseded=%d, suppressed=%d, capped=%d, deferred=%d",
+		len(results), counts[deliverySent], counts[deliveryFailed], counts[deliverySuperseded], counts[deliverySuppressed],
+		counts[deliveryCapped], counts[deliveryDeferred])
+}
+
+// sleepUntil blocks until t or until the context is cancelled
+func sleepUntil(ctx context.Context, t time.Time) error {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubSender returns "<name>-1" as message id, after waiting for release when it is set
+type stubSender struct {
+	name    string
+	release chan struct{}
+	sent    atomic.Int32
+}
+
+func (s *stubSender) Name() string { return s.name }
+
+func (s *stubSender) Send(ctx context.Context, notification Notification) (string, error) {
+	if s.release != nil {
+		<-s.release
+	}
+	s.sent.Add(1)
+	return s.name + "-1", nil
+}
+
+func TestDispatcherMirrorsInBackground(t *testing.T) {
+	push := &stubSender{name: "push"}
+	slowSink := &stubSender{name: "webhook", release: make(chan struct{})}
+	dispatcher := newDispatcher(log.New(io.Discard, "", 0))
+	dispatcher.Register("push", push)
+	dispatcher.AddSink(slowSink)
+
+	delivered := make(chan DeliveryResult)
+	go func() {
+		delivered <- dispatcher.deliver(context.Background(), Notification{UserID: 1, Event: "PAN_FORM_DROPOFF", Channel: "push"})
+	}()
+	select {
+	case result := <-delivered:
+		if result.Status != deliverySent || result.MessageID != "push-1" {
+			t.Errorf("result = %s %q, want sent push-1", result.Status, result.MessageID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliver waited for the slow sink")
+	}
+
+	close(slowSink.release)
+	dispatcher.waitForMirrors()
+	if sent := slowSink.sent.Load(); sent != 1 {
+		t.Errorf("sink received %d notifications, want 1", sent)
+	}
+}
+
+func TestDispatcherDropsMirrorCopiesWhenQueueIsFull(t *testing.T) {
+	push := &stubSender{name: "push"}
+	slowSink := &stubSender{name: "webhook", release: make(chan struct{})}
+	dispatcher := newDispatcher(log.New(io.Discard, "", 0))
+	dispatcher.mirrorQueueSize, dispatcher.mirrorWorkers = 1, 1
+	dispatcher.Register("push", push)
+	dispatcher.AddSink(slowSink)
+
+	// The worker holds the first copy; wait for it so the second one is the only one queued
+	dispatcher.deliver(context.Background(), Notification{UserID: 1, Event: "PAN_FORM_DROPOFF", Channel: "push"})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dispatcher.sinks[0].notifications) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for userID := uint32(2); userID <= 4; userID++ {
+		dispatcher.deliver(context.Background(), Notification{UserID: userID, Event: "PAN_FORM_DROPOFF", Channel: "push"})
+	}
+	if dropped := dispatcher.mirrorsDropped.Load(); dropped != 2 {
+		t.Errorf("dropped %d mirror copies, want 2", dropped)
+	}
+
+	close(slowSink.release)
+	dispatcher.waitForMirrors()
+	if sent := slowSink.sent.Load(); sent != 2 {
+		t.Errorf("sink received %d notifications, want 2", sent)
+	}
+	if sent := push.sent.Load(); sent != 4 {
+		t.Errorf("push sent %d notifications, want 4", sent)
+	}
+}
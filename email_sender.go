@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// emailAttachment is a file attached to an outgoing email
+type emailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// emailAttachmentHook produces attachments for a notification, e.g. a rejection letter
+type emailAttachmentHook func(ctx context.Context, notification Notification) ([]emailAttachment, error)
+
+// emailTemplate is the subject, plain-text and HTML template set for one event
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// loadEmailTemplates reads <EVENT>.subject.tmpl, <EVENT>.txt.tmpl and <EVENT>.html.tmpl from dir
+func loadEmailTemplates(dir string) (map[string]*emailTemplate, error) {
+	subjects, err := filepath.Glob(filepath.Join(dir, "*.subject.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing email templates in %s: %v", dir, err)
+	}
+	if len(subjects) == 0 {
+		return nil, fmt.Errorf("no email templates (*.subject.tmpl) found in %s", dir)
+	}
+
+	templates := make(map[string]*emailTemplate)
+	for _, subjectPath := range subjects {
+		event := strings.TrimSuffix(filepath.Base(subjectPath), ".subject.tmpl")
+		t := &emailTemplate{}
+		if t.subject, err = texttemplate.ParseFiles(subjectPath); err != nil {
+			return nil, fmt.Errorf("error parsing email subject template for %s: %v", event, err)
+		}
+		if t.text, err = texttemplate.ParseFiles(filepath.Join(dir, event+".txt.tmpl")); err != nil {
+			return nil, fmt.Errorf("error parsing email text template for %s: %v", event, err)
+		}
+		if t.html, err = htmltemplate.ParseFiles(filepath.Join(dir, event+".html.tmpl")); err != nil {
+			return nil, fmt.Errorf("error parsing email HTML template for %s: %v", event, err)
+		}
+		templates[event] = t
+	}
+	return templates, nil
+}
+
+// emailSender renders email templates and sends them over SMTP
+type emailSender struct {
+	host      string
+	addr      string // host:port of the SMTP server
+	auth      smtp.Auth
+	timeout   time.Duration // Bounds the whole SMTP conversation of one email
+	from      mail.Address
+	templates map[string]*emailTemplate
+	hooks     map[string]emailAttachmentHook
+}
+
+// newEmailSender creates an SMTP email sender; auth is skipped when username is empty
+func newEmailSender(host, port, username, password, from string, templates map[string]*emailTemplate) (*emailSender, error) {
+	if host == "" {
+		return nil, fmt.Errorf("SMTP host must be set")
+	}
+	if port == "" {
+		port = "587"
+	}
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %v", from, err)
+	}
+
+	sender := &emailSender{
+		host:      host,
+		addr:      net.JoinHostPort(host, port),
+		timeout:   10 * time.Second,
+		from:      *fromAddress,
+		templates: templates,
+		hooks:     make(map[string]emailAttachmentHook),
+	}
+	if username != "" {
+		sender.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return sender, nil
+}
+
+// Name identifies the sender
+func (s *emailSender) Name() string { return "smtp" }
+
+// RegisterAttachmentHook attaches the hook's files to every email for the event
+func (s *emailSender) RegisterAttachmentHook(event string, hook emailAttachmentHook) {
+	s.hooks[event] = hook
+}
+
+// Send renders the event's templates and delivers them to the user's email address
+func (s *emailSender) Send(ctx context.Context, notification Notification) (string, error) {
+	if notification.Email == "" {
+		return "", fmt.Errorf("no email address for user_id %d", notification.UserID)
+	}
+	template, ok := s.templates[notification.Event]
+	if !ok {
+		return "", fmt.Errorf("no email template for event %s", notification.Event)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := template.subject.Execute(&subject, notification); err != nil {
+		return "", fmt.Errorf("error rendering email subject for %s: %v", notification.Event, err)
+	}
+	if err := template.text.Execute(&text, notification); err != nil {
+		return "", fmt.Errorf("error rendering email text for %s: %v", notification.Event, err)
+	}
+	if err := template.html.Execute(&html, notification); err != nil {
+		return "", fmt.Errorf("error rendering email HTML for %s: %v", notification.Event, err)
+	}
+
+	var attachments []emailAttachment
+	if hook, ok := s.hooks[notification.Event]; ok {
+		var err error
+		if attachments, err = hook(ctx, notification); err != nil {
+			return "", fmt.Errorf("error building attachments for %s: %v", notification.Event, err)
+		}
+	}
+
+	messageID, err := newMessageID(s.from.Address, notification.IdempotencyKey)
+	if err != nil {
+		return "", err
+	}
+	to := mail.Address{Name: notification.Metadata["Name"], Address: notification.Email}
+	message, err := buildMIMEMessage(s.from, to, strings.TrimSpace(subject.String()), messageID, text.Bytes(), html.Bytes(), attachments)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.sendMail(ctx, notification.Email, message); err != nil {
+		return "", fmt.Errorf("error sending email via %s: %v", s.addr, err)
+	}
+	return messageID, nil
+}
+
+// sendMail delivers message to one recipient like smtp.SendMail, but gives up when ctx is done or the sender's
+// timeout passes, so a hung SMTP server cannot block the queue
+func (s *emailSender) sendMail(ctx context.Context, to string, message []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// Interrupt a blocked read or write as soon as ctx is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(s.auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := client.Mail(s.from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// newMessageID builds the Message-ID in the sender's domain from the idempotency key, so a resent email
+// is recognised as a duplicate by mail servers; it is random when there is no key
+func newMessageID(from, idempotencyKey string) (string, error) {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	if idempotencyKey != "" {
+		return fmt.Sprintf("<%s@%s>", idempotencyKey, domain), nil
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("error generating message id: %v", err)
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain), nil
+}
+
+// buildMIMEMessage assembles a multipart/mixed message with text and HTML alternatives and attachments
+func buildMIMEMessage(from, to mail.Address, subject, messageID string, text, html []byte, attachments []emailAttachment) ([]byte, error) {
+	var buf bytes.Buffer
+	mixed := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", messageID)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary())
+
+	// Text and HTML bodies as alternatives
+	var alternativeBuf bytes.Buffer
+	alternative := multipart.NewWriter(&alternativeBuf)
+	for _, body := range []struct {
+		contentType string
+		data        []byte
+	}{{"text/plain; charset=utf-8", text}, {"text/html; charset=utf-8", html}} {
+		part, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writer := quotedprintable.NewWriter(part)
+		if _, err := writer.Write(body.data); err != nil {
+			return nil, err
+		}
+		writer.Close()
+	}
+	alternative.Close()
+
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(alternativeBuf.Bytes())
+
+	for _, attachment := range attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	mixed.Close()
+	return buf.Bytes(), nil
+}
+
+// rejectionLetterHook renders <EVENT>.letter.html.tmpl from dir as an HTML rejection letter attachment
+func rejectionLetterHook(dir, event string) (emailAttachmentHook, error) {
+	path := filepath.Join(dir, event+".letter.html.tmpl")
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	letter, err := htmltemplate.ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rejection letter template: %v", err)
+	}
+	return func(ctx context.Context, notification Notification) ([]emailAttachment, error) {
+		var buf bytes.Buffer
+		if err := letter.Execute(&buf, notification); err != nil {
+			return nil, fmt.Errorf("error rendering rejection letter: %v", err)
+		}
+		return []emailAttachment{{
+			Filename:    "rejection_letter.html",
+			ContentType: "text/html; charset=utf-8",
+			Data:        buf.Bytes(),
+		}}, nil
+	}, nil
+}
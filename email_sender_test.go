@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMessage is an email received by the SMTP sink
+type smtpMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// newSMTPSink starts a minimal SMTP server on localhost collecting the messages it receives and returns its port
+func newSMTPSink(t *testing.T) (string, chan smtpMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, messages
+}
+
+// serveSMTP answers one SMTP session, without STARTTLS or AUTH
+func serveSMTP(conn net.Conn, messages chan smtpMessage) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP sink")
+	var message smtpMessage
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			message = smtpMessage{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			message.to = append(message.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			if message.data, err = text.ReadDotBytes(); err != nil {
+				return
+			}
+			messages <- message
+			text.PrintfLine("250 OK queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// newTestEmailSender creates a sender for the sink on port with the shipped templates and rejection letter
+func newTestEmailSender(t *testing.T, port string) *emailSender {
+	t.Helper()
+	templates, err := loadEmailTemplates("email_templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := newEmailSender("127.0.0.1", port, "", "", "Cards Team <cards@example.com>", templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := rejectionLetterHook("email_templates", "CREDIT_CARD_REJECTED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.RegisterAttachmentHook("CREDIT_CARD_REJECTED", hook)
+	return sender
+}
+
+func TestEmailSenderSendsAlternativesAndRejectionLetter(t *testing.T) {
+	port, messages := newSMTPSink(t)
+	sender := newTestEmailSender(t, port)
+
+	notification := Notification{
+		UserID:         7,
+		Event:          "CREDIT_CARD_REJECTED",
+		Email:          "asha@example.com",
+		IdempotencyKey: "0123456789abcdef",
+		ScheduledAt:    time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+		Metadata:       map[string]string{"Name": "Asha", "Reasons": "LOW_SCORE"},
+	}
+	messageID, err := sender.Send(context.Background(), notification)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if want := "<0123456789abcdef@example.com>"; messageID != want {
+		t.Errorf("message id = %s, want %s", messageID, want)
+	}
+
+	var received smtpMessage
+	select {
+	case received = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received by the SMTP sink")
+	}
+	if received.from != "cards@example.com" || len(received.to) != 1 || received.to[0] != "asha@example.com" {
+		t.Errorf("envelope = %s -> %v, want cards@example.com -> [asha@example.com]", received.from, received.to)
+	}
+
+	message, err := mail.ReadMessage(bytes.NewReader(received.data))
+	if err != nil {
+		t.Fatalf("error parsing message: %v", err)
+	}
+	if got := message.Header.Get("Message-ID"); got != messageID {
+		t.Errorf("Message-ID header = %s, want %s", got, messageID)
+	}
+	if got := message.Header.Get("Subject"); got == "" {
+		t.Error("no Subject header")
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %s, want multipart/mixed", message.Header.Get("Content-Type"))
+	}
+
+	mixed := multipart.NewReader(message.Body, params["boundary"])
+	alternativePart, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ = mime.ParseMediaType(alternativePart.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("first part is %s, want multipart/alternative", mediaType)
+	}
+	alternative := multipart.NewReader(alternativePart, params["boundary"])
+	for _, want := range []struct {
+		contentType string
+		contains    string
+	}{{"text/plain", "Reason: LOW_SCORE"}, {"text/html", "<p>Reason: LOW_SCORE</p>"}} {
+		part, err := alternative.NextPart()
+		if err != nil {
+			t.Fatalf("missing %s alternative: %v", want.contentType, err)
+		}
+		body, _ := io.ReadAll(part) // NextPart decodes quoted-printable
+		if mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); mediaType != want.contentType {
+			t.Errorf("alternative is %s, want %s", mediaType, want.contentType)
+		}
+		if !strings.Contains(string(body), want.contains) || !strings.Contains(string(body), "Asha") {
+			t.Errorf("%s body does not contain %q and the name:\n%s", want.contentType, want.contains, body)
+		}
+	}
+
+	attachment, err := mixed.NextPart()
+	if err != nil {
+		t.Fatalf("missing rejection letter attachment: %v", err)
+	}
+	if attachment.FileName() != "rejection_letter.html" {
+		t.Errorf("attachment filename = %s, want rejection_letter.html", attachment.FileName())
+	}
+	encoded, _ := io.ReadAll(attachment)
+	letter, err := decodeBase64Lines(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(letter, "02 Mar 2026") || !strings.Contains(letter, "Reason: LOW_SCORE") {
+		t.Errorf("rejection letter does not contain the date and reason:\n%s", letter)
+	}
+	if _, err := mixed.NextPart(); err != io.EOF {
+		t.Errorf("unexpected part after the attachment: %v", err)
+	}
+}
+
+// decodeBase64Lines decodes a base64 body wrapped at 76 characters
+func decodeBase64Lines(encoded []byte) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.NewReplacer("\r", "", "\n", "").Replace(string(encoded)))
+	return string(decoded), err
+}
+
+func TestEmailSenderTimesOutOnHungServer(t *testing.T) {
+	// Accepts connections but never greets, like a hung SMTP server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	sender := newTestEmailSender(t, port)
+	sender.timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err = sender.Send(context.Background(), Notification{
+		Event:    "ARN_GENERATED",
+		Email:    "asha@example.com",
+		Metadata: map[string]string{"Name": "Asha", "Arn": "ARN000001"},
+	})
+	if err == nil {
+		t.Fatal("Send to a hung server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send returned after %s, want it bounded by the timeout", elapsed)
+	}
+}
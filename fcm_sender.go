@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fcmScope is the OAuth scope required by the FCM HTTP v1 API
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// serviceAccount holds the fields we need from a Google service account JSON key
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// InvalidTokenError reports a device token that FCM will never deliver to again
+type InvalidTokenError struct {
+	UserID uint32
+	Token  string
+	Reason string // UNREGISTERED or INVALID_ARGUMENT
+}
+
+func (e *InvalidTokenError) Error() string {
+	return fmt.Sprintf("invalid device token for user_id %d: %s", e.UserID, e.Reason)
+}
+
+// fcmSender sends push notifications through the FCM HTTP v1 API
+type fcmSender struct {
+	account  serviceAccount
+	key      *rsa.PrivateKey
+	endpoint string // Base URL, overridable to point at a local fake FCM server
+	client   *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+
+	onInvalidToken func(*InvalidTokenError)
+}
+
+// newFCMSender loads the service account key file and prepares an FCM sender
+func newFCMSender(serviceAccountFile, endpoint string, onInvalidToken func(*InvalidTokenError)) (*fcmSender, error) {
+	data, err := os.ReadFile(serviceAccountFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading FCM service account file: %v", err)
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("error parsing FCM service account file: %v", err)
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, fmt.Errorf("FCM service account file must contain project_id, client_email and token_uri")
+	}
+
+	key, err := parseRSAPrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing FCM service account private key: %v", err)
+	}
+
+	if endpoint == "" {
+		endpoint = "https://fcm.googleapis.com"
+	}
+	return &fcmSender{
+		account:        account,
+		key:            key,
+		endpoint:       strings.TrimRight(endpoint, "/"),
+		client:         &http.Client{Timeout: 10 * time.Second},
+		onInvalidToken: onInvalidToken,
+	}, nil
+}
+
+// parseRSAPrivateKey decodes a PEM encoded PKCS#8 or PKCS#1 RSA private key
+func parseRSAPrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// Name identifies the sender
+func (s *fcmSender) Name() string { return "fcm" }
+
+// token returns a cached OAuth access token, exchanging a signed JWT for a new one when needed
+func (s *fcmSender) token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && time.Now().Before(s.expiresAt.Add(-time.Minute)) {
+		return s.accessToken, nil
+	}
+
+	assertion, err := s.signJWT(time.Now())
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting FCM access token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error requesting FCM access token: status %d: %s", resp.StatusCode, body)
+	}
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil || tokenResponse.AccessToken == "" {
+		return "", fmt.Errorf("error decoding FCM access token response: %s", body)
+	}
+	s.accessToken = tokenResponse.AccessToken
+	s.expiresAt = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	log.Printf("Obtained FCM access token for %s, expires at %s", s.account.ClientEmail, s.expiresAt.Format(time.RFC3339))
+	return s.accessToken, nil
+}
+
+// signJWT builds the RS256 signed assertion for the service account token exchange
+func (s *fcmSender) signJWT(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("error signing FCM JWT: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// fcmMessage builds the v1 message; data-only so the app renders the journey nudge itself
+func fcmMessage(notification Notification) map[string]interface{} {
+	data := map[string]string{
+		"event":          notification.Event,
+		"event_id":       strconv.Itoa(notification.EventID),
+		"attempt":        strconv.Itoa(notification.Attempt),
+		"current_status": notification.CurrentStatus,
+		"source":         notification.Source,
+	}
+	for key, value := range notification.Metadata {
+		data["metadata_"+strings.ToLower(key)] = value
+	}
+
+	message := map[string]interface{}{
+		"token": notification.DeviceToken,
+		"data":  data,
+	}
+	switch strings.ToLower(notification.Platform) {
+	case "ios":
+		// iOS only wakes the app for data messages sent as background pushes
+		message["apns"] = map[string]interface{}{
+			"headers": map[string]string{
+				"apns-push-type": "background",
+				"apns-priority":  "5",
+			},
+			"payload": map[string]interface{}{
+				"aps": map[string]interface{}{"content-available": 1},
+			},
+		}
+	default:
+		message["android"] = map[string]interface{}{"priority": "high"}
+	}
+	return map[string]interface{}{"message": message}
+}
+
+// Send delivers the notification to the user's device token
+func (s *fcmSender) Send(ctx context.Context, notification Notification) (string, error) {
+	if notification.DeviceToken == "" {
+		return "", fmt.Errorf("no device token for user_id %d", notification.UserID)
+	}
+
+	accessToken, err := s.token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(fcmMessage(notification))
+	if err != nil {
+		return "", fmt.Errorf("error encoding FCM message: %v", err)
+	}
+	sendURL := fmt.Sprintf("%s/v1/projects/%s/messages:send", s.endpoint, s.account.ProjectID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sendURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling FCM: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusOK {
+		var sendResponse struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(body, &sendResponse); err != nil {
+			return "", fmt.Errorf("error decoding FCM response: %v", err)
+		}
+		return sendResponse.Name, nil
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Force a fresh access token on the next send
+		s.mu.Lock()
+		s.accessToken = ""
+		s.mu.Unlock()
+	}
+
+	errorCode := fcmErrorCode(body)
+	if errorCode == "UNREGISTERED" || errorCode == "INVALID_ARGUMENT" {
+		invalid := &InvalidTokenError{UserID: notification.UserID, Token: notification.DeviceToken, Reason: errorCode}
+		if s.onInvalidToken != nil {
+			s.onInvalidToken(invalid)
+		}
+		return "", invalid
+	}
+	return "", fmt.Errorf("FCM returned status %d (%s): %s", resp.StatusCode, errorCode, body)
+}
+
+// fcmErrorCode extracts the FcmError errorCode from an error response, falling back to the status
+func fcmErrorCode(body []byte) string {
+	var errorResponse struct {
+		Error struct {
+			Status  string `json:"status"`
+			Details []struct {
+				Type      string `json:"@type"`
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		return ""
+	}
+	for _, detail := range errorResponse.Error.Details {
+		if strings.HasSuffix(detail.Type, "google.firebase.fcm.v1.FcmError") && detail.ErrorCode != "" {
+			return detail.ErrorCode
+		}
+	}
+	return errorResponse.Error.Status
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeFCM is a local FCM HTTP v1 server with its token endpoint
+type fakeFCM struct {
+	server     *httptest.Server
+	key        *rsa.PrivateKey
+	tokenCalls atomic.Int32
+	messages   chan map[string]interface{}
+	sendStatus int    // Status returned by messages:send, 200 when zero
+	sendBody   string // Body returned by messages:send when sendStatus is set
+}
+
+// newFakeFCM starts the fake server and writes a service account key file pointing at it
+func newFakeFCM(t *testing.T) (*fakeFCM, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeFCM{key: key, messages: make(chan map[string]interface{}, 10)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", fake.handleToken(t))
+	mux.HandleFunc("/v1/projects/test-project/messages:send", fake.handleSend(t))
+	fake.server = httptest.NewServer(mux)
+	t.Cleanup(fake.server.Close)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _ := json.Marshal(serviceAccount{
+		ProjectID:   "test-project",
+		ClientEmail: "comms@test-project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    fake.server.URL + "/token",
+	})
+	path := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(path, account, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fake, path
+}
+
+// handleToken checks the signed JWT assertion and issues an access token
+func (f *fakeFCM) handleToken(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.tokenCalls.Add(1)
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("error parsing token request: %v", err)
+		}
+		if grantType := r.PostForm.Get("grant_type"); grantType != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("grant_type = %q", grantType)
+		}
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if len(parts) != 3 {
+			t.Errorf("assertion has %d parts, want 3", len(parts))
+			http.Error(w, "bad assertion", http.StatusBadRequest)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("assertion signature does not verify: %v", err)
+		}
+		var claims map[string]interface{}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Errorf("error decoding assertion claims: %v", err)
+		}
+		if claims["scope"] != fcmScope || claims["aud"] != f.server.URL+"/token" {
+			t.Errorf("unexpected claims %v", claims)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token": "fake-access-token", "expires_in": 3600}`)
+	}
+}
+
+// handleSend records the message and answers with the configured response
+func (f *fakeFCM) handleSend(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer fake-access-token" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding message: %v", err)
+		}
+		f.messages <- body
+		if f.sendStatus != 0 {
+			w.WriteHeader(f.sendStatus)
+			io.WriteString(w, f.sendBody)
+			return
+		}
+		io.WriteString(w, `{"name": "projects/test-project/messages/0:1"}`)
+	}
+}
+
+func testPushNotification(platform string) Notification {
+	return Notification{
+		Event:       "PAN_FORM_DROPOFF",
+		EventID:     7,
+		Attempt:     2,
+		UserID:      42,
+		Source:      "test",
+		Channel:     "push",
+		DeviceToken: "device-token",
+		Platform:    platform,
+		Metadata:    map[string]string{"Name": "Asha"},
+	}
+}
+
+func TestFCMSenderTokenExchange(t *testing.T) {
+	fake, path := newFakeFCM(t)
+	sender, err := newFCMSender(path, fake.server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		messageID, err := sender.Send(context.Background(), testPushNotification("android"))
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if messageID != "projects/test-project/messages/0:1" {
+			t.Errorf("message id = %q", messageID)
+		}
+		<-fake.messages
+	}
+	if calls := fake.tokenCalls.Load(); calls != 1 {
+		t.Errorf("token endpoint called %d times, want the access token cached after 1", calls)
+	}
+}
+
+func TestFCMSenderPlatformPayloads(t *testing.T) {
+	fake, path := newFakeFCM(t)
+	sender, err := newFCMSender(path, fake.server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		platform string
+		check    func(t *testing.T, message map[string]interface{})
+	}{
+		{"android", func(t *testing.T, message map[string]interface{}) {
+			android, ok := message["android"].(map[string]interface{})
+			if !ok || android["priority"] != "high" {
+				t.Errorf("android = %v, want high priority", message["android"])
+			}
+			if _, ok := message["apns"]; ok {
+				t.Errorf("android message has an apns block")
+			}
+		}},
+		{"iOS", func(t *testing.T, message map[string]interface{}) {
+			apns, ok := message["apns"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("ios message has no apns block: %v", message)
+			}
+			headers := apns["headers"].(map[string]interface{})
+			if headers["apns-push-type"] != "background" || headers["apns-priority"] != "5" {
+				t.Errorf("apns headers = %v", headers)
+			}
+			aps := apns["payload"].(map[string]interface{})["aps"].(map[string]interface{})
+			if aps["content-available"] != float64(1) {
+				t.Errorf("aps = %v, want content-available", aps)
+			}
+			if _, ok := message["android"]; ok {
+				t.Errorf("ios message has an android block")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			if _, err := sender.Send(context.Background(), testPushNotification(tt.platform)); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			message := (<-fake.messages)["message"].(map[string]interface{})
+			if message["token"] != "device-token" {
+				t.Errorf("token = %v", message["token"])
+			}
+			data := message["data"].(map[string]interface{})
+			if data["event"] != "PAN_FORM_DROPOFF" || data["event_id"] != "7" || data["attempt"] != "2" || data["metadata_name"] != "Asha" {
+				t.Errorf("data = %v", data)
+			}
+			tt.check(t, message)
+		})
+	}
+}
+
+func TestFCMSenderUnregisteredToken(t *testing.T) {
+	fake, path := newFakeFCM(t)
+	fake.sendStatus = http.StatusNotFound
+	fake.sendBody = `{"error": {"code": 404, "status": "NOT_FOUND", "details": [
+		{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`
+	report := &invalidTokenReport{}
+	sender, err := newFCMSender(path, fake.server.URL, report.add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sender.Send(context.Background(), testPushNotification("android"))
+	<-fake.messages
+	var invalid *InvalidTokenError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Send error = %v, want an InvalidTokenError", err)
+	}
+	if invalid.Reason != "UNREGISTERED" || invalid.UserID != 42 || invalid.Token != "device-token" {
+		t.Errorf("invalid token = %+v", invalid)
+	}
+	if len(report.tokens) != 1 || report.tokens[0] != invalid {
+		t.Errorf("reported tokens = %v, want the invalid token once", report.tokens)
+	}
+
+	// The dispatcher keeps the error type, so the queue can fail the job without retrying it
+	dispatcher := newDispatcher(log.New(io.Discard, "", 0))
+	dispatcher.Register("push", sender)
+	result := dispatcher.deliver(context.Background(), testPushNotification("android"))
+	<-fake.messages
+	if result.Status != deliveryFailed || !errors.As(result.Err, &invalid) {
+		t.Errorf("result = %s, %v, want failed with an InvalidTokenError", result.Status, result.Err)
+	}
+}
+
+func TestFCMSenderOtherErrors(t *testing.T) {
+	fake, path := newFakeFCM(t)
+	fake.sendStatus = http.StatusServiceUnavailable
+	fake.sendBody = `{"error": {"code": 503, "status": "UNAVAILABLE"}}`
+	report := &invalidTokenReport{}
+	sender, err := newFCMSender(path, fake.server.URL, report.add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sender.Send(context.Background(), testPushNotification("android"))
+	<-fake.messages
+	var invalid *InvalidTokenError
+	if err == nil || errors.As(err, &invalid) {
+		t.Fatalf("Send error = %v, want a retryable error", err)
+	}
+	if len(report.tokens) != 0 {
+		t.Errorf("reported tokens = %v, want none", report.tokens)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Frequency cap policies
+const (
+	capDefer = "defer" // Hold the notification until the capped period ends
+	capDrop  = "drop"  // Cancel the notification
+)
+
+// frequencyCaps holds the caps of the loaded rules file; Release applies them before every send
+var frequencyCaps FrequencyCaps
+
+// FrequencyCaps limit how many messages a user receives, counted from notification_status send history
+type FrequencyCaps struct {
+	Categories map[string][]string `yaml:"categories" json:"categories"` // Category -> events, for category caps
+	Exempt     []string            `yaml:"exempt" json:"exempt"`         // Events never capped, e.g. transactional ones; still counted
+	Caps       []FrequencyCap      `yaml:"caps" json:"caps"`
+
+	categoryOf map[string]string
+	exempt     map[string]bool
+}
+
+// FrequencyCap allows at most Max sent messages per calendar day or week (Asia/Kolkata, weeks start on Monday)
+type FrequencyCap struct {
+	Period   string `yaml:"period" json:"period"`     // day or week
+	Max      int    `yaml:"max" json:"max"`           // Sent messages allowed in the period
+	Channel  string `yaml:"channel" json:"channel"`   // Only count and cap this channel; all channels when empty
+	Category string `yaml:"category" json:"category"` // Only count and cap events of this category; all events when empty
+	Policy   string `yaml:"policy" json:"policy"`     // defer (default) or drop
+}
+
+// resolve validates the caps and indexes categories and exempt events
+func (f *FrequencyCaps) resolve() error {
+	f.categoryOf = make(map[string]string)
+	for category, events := range f.Categories {
+		for _, event := range events {
+			if other, exists := f.categoryOf[event]; exists {
+				return fmt.Errorf("event %s is in frequency cap categories %s and %s", event, other, category)
+			}
+			f.categoryOf[event] = category
+		}
+	}
+	f.exempt = make(map[string]bool, len(f.Exempt))
+	for _, event := range f.Exempt {
+		f.exempt[event] = true
+	}
+	for i := range f.Caps {
+		c := &f.Caps[i]
+		if c.Period != "day" && c.Period != "week" {
+			return fmt.Errorf("frequency cap %d: unknown period %q, expected day or week", i+1, c.Period)
+		}
+		if c.Max < 0 {
+			return fmt.Errorf("frequency cap %d: max must not be negative", i+1)
+		}
+		if c.Category != "" {
+			if _, ok := f.Categories[c.Category]; !ok {
+				return fmt.Errorf("frequency cap %d: unknown category %q", i+1, c.Category)
+			}
+		}
+		if c.Policy == "" {
+			c.Policy = capDefer
+		}
+		if c.Policy != capDefer && c.Policy != capDrop {
+			return fmt.Errorf("frequency cap %d: unknown policy %q, expected defer or drop", i+1, c.Policy)
+		}
+		c.Channel = normalizeChannel(c.Channel)
+	}
+	return nil
+}
+
+// String describes the cap in logs and notification_status
+func (c FrequencyCap) String() string {
+	scope := []string{fmt.Sprintf("%d per %s", c.Max, c.Period)}
+	if c.Channel != "" {
+		scope = append(scope, "channel "+c.Channel)
+	}
+	if c.Category != "" {
+		scope = append(scope, "category "+c.Category)
+	}
+	return strings.Join(scope, ", ")
+}
+
+// period returns the calendar day or week containing t and the start of the next one
+func (c FrequencyCap) period(t time.Time) (time.Time, time.Time) {
+	local := t.In(istLocation)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, istLocation)
+	if c.Period == "week" {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+// matches reports whether a message on channel for event counts towards the cap
+func (f *FrequencyCaps) matches(c FrequencyCap, channel, event string) bool {
+	if c.Channel != "" && normalizeChannel(channel) != c.Channel {
+		return false
+	}
+	return c.Category == "" || f.categoryOf[event] == c.Category
+}
+
+// checkFrequencyCaps counts the user's sent messages against every cap the notification falls under. It returns
+// the exceeded cap with the strictest policy (drop before defer, then the latest period end) and when that
+// period ends, or false when the notification may be sent
+func checkFrequencyCaps(db *gorm.DB, notification Notification, now time.Time) (FrequencyCap, time.Time, bool, error) {
+	var applicable []FrequencyCap
+	since := now
+	for _, c := range frequencyCaps.Caps {
+		if frequencyCaps.exempt[notification.Event] || !frequencyCaps.matches(c, notification.Channel, notification.Event) {
+			continue
+		}
+		applicable = append(applicable, c)
+		if start, _ := c.period(now); start.Before(since) {
+			since = start
+		}
+	}
+	if len(applicable) == 0 {
+		return FrequencyCap{}, time.Time{}, false, nil
+	}
+
+	var history []struct {
+		EventName string
+		Channel   string
+		SentAt    time.Time
+	}
+	err := db.Raw(`SELECT event_name, channel, sent_at FROM notification_status WHERE user_id = ? AND status = ? AND sent_at >= ?`,
+		notification.UserID, deliverySent, since).Scan(&history).Error
+	if err != nil {
+		log.Printf("Error fetching send history for user_id %d: %v", notification.UserID, err)
+		return FrequencyCap{}, time.Time{}, false, fmt.Errorf("error fetching send history for user_id %d: %v", notification.UserID, err)
+	}
+
+	var exceeded FrequencyCap
+	var until time.Time
+	found := false
+	for _, c := range applicable {
+		start, next := c.period(now)
+		sent := 0
+		for _, message := range history {
+			if !message.SentAt.Before(start) && frequencyCaps.matches(c, message.Channel, message.EventName) {
+				sent++
+			}
+		}
+		if sent < c.Max {
+			continue
+		}
+		if !found || c.Policy == capDrop && exceeded.Policy != capDrop || c.Policy == exceeded.Policy && next.After(until) {
+			exceeded, until, found = c, next, true
+		}
+	}
+	return exceeded, until, found, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrequencyCapPeriod(t *testing.T) {
+	day := FrequencyCap{Period: "day"}
+	week := FrequencyCap{Period: "week"}
+	// 2026-03-02 is a Monday
+	tests := []struct {
+		name      string
+		cap       FrequencyCap
+		t         time.Time
+		wantStart time.Time
+	}{
+		{"day, midday", day, ist(2, 12, 0), ist(2, 0, 0)},
+		{"day, at midnight", day, ist(2, 0, 0), ist(2, 0, 0)},
+		{"day, a minute before midnight", day, ist(2, 23, 59), ist(2, 0, 0)},
+		{"day, previous UTC date", day, time.Date(2026, 3, 1, 20, 0, 0, 0, time.UTC), ist(2, 0, 0)},
+		{"day, before IST midnight in UTC", day, time.Date(2026, 3, 1, 18, 29, 0, 0, time.UTC), ist(1, 0, 0)},
+		{"week, Monday midnight", week, ist(2, 0, 0), ist(2, 0, 0)},
+		{"week, Wednesday", week, ist(4, 15, 0), ist(2, 0, 0)},
+		{"week, Sunday night", week, ist(8, 23, 59), ist(2, 0, 0)},
+		{"week, Sunday before the week", week, ist(1, 12, 0), time.Date(2026, 2, 23, 0, 0, 0, 0, istLocation)},
+		{"week, Monday in IST but Sunday in UTC", week, time.Date(2026, 3, 1, 18, 30, 0, 0, time.UTC), ist(2, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.cap.period(tt.t)
+			wantEnd := tt.wantStart.AddDate(0, 0, 1)
+			if tt.cap.Period == "week" {
+				wantEnd = tt.wantStart.AddDate(0, 0, 7)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(wantEnd) {
+				t.Errorf("period(%s) = %s - %s, want %s - %s", tt.t, start, end, tt.wantStart, wantEnd)
+			}
+		})
+	}
+}
+
+func TestFrequencyCapsMatches(t *testing.T) {
+	caps := FrequencyCaps{
+		Categories: map[string][]string{"dropoff": {"PAN_FORM_DROPOFF", "VKYC_DROPOFF"}},
+		Caps: []FrequencyCap{
+			{Period: "day", Max: 3},
+			{Period: "day", Max: 2, Channel: " SMS"},
+			{Period: "week", Max: 5, Category: "dropoff"},
+			{Period: "week", Max: 1, Channel: "push", Category: "dropoff"},
+		},
+	}
+	if err := caps.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		channel, event string
+		want           []bool // Per cap
+	}{
+		{"sms", "PAN_FORM_DROPOFF", []bool{true, true, true, false}},
+		{"SMS", "ARN_GENERATED", []bool{true, true, false, false}},
+		{"push", "VKYC_DROPOFF", []bool{true, false, true, true}},
+		{"email", "CREDIT_CARD_REJECTED", []bool{true, false, false, false}},
+	}
+	for _, tt := range tests {
+		for i, c := range caps.Caps {
+			if got := caps.matches(c, tt.channel, tt.event); got != tt.want[i] {
+				t.Errorf("cap %s matches %s on %s = %t, want %t", c, tt.event, tt.channel, got, tt.want[i])
+			}
+		}
+	}
+	if caps.Caps[1].Policy != capDefer {
+		t.Errorf("default policy = %q, want %q", caps.Caps[1].Policy, capDefer)
+	}
+}
+
+func TestFrequencyCapsResolveErrors(t *testing.T) {
+	tests := []struct {
+		caps    FrequencyCaps
+		wantErr string
+	}{
+		{FrequencyCaps{Caps: []FrequencyCap{{Period: "month", Max: 1}}}, "unknown period"},
+		{FrequencyCaps{Caps: []FrequencyCap{{Period: "day", Max: -1}}}, "must not be negative"},
+		{FrequencyCaps{Caps: []FrequencyCap{{Period: "day", Max: 1, Category: "promo"}}}, "unknown category"},
+		{FrequencyCaps{Caps: []FrequencyCap{{Period: "day", Max: 1, Policy: "delay"}}}, "unknown policy"},
+		{FrequencyCaps{Categories: map[string][]string{"a": {"PAN_FORM_DROPOFF"}, "b": {"PAN_FORM_DROPOFF"}}}, "is in frequency cap categories"},
+	}
+	for _, tt := range tests {
+		if err := tt.caps.resolve(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("resolve error = %v, want it to contain %q", err, tt.wantErr)
+		}
+	}
+}
+
+// setFrequencyCaps resolves and installs caps for the test
+func setFrequencyCaps(t *testing.T, caps FrequencyCaps) {
+	t.Helper()
+	if err := caps.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	frequencyCaps = caps
+	t.Cleanup(func() { frequencyCaps = FrequencyCaps{} })
+}
+
+// insertSentHistory records sent messages for the user in notification_status
+func insertSentHistory(t *testing.T, queue *jobQueue, userID uint32, event, channel string, sentAt ...time.Time) {
+	t.Helper()
+	for _, at := range sentAt {
+		if err := queue.db.Exec(`INSERT INTO notification_status (user_id, event_name, attempt, channel, status, sent_at) VALUES (?, ?, 1, ?, ?, ?)`,
+			userID, event, channel, deliverySent, at).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckFrequencyCaps(t *testing.T) {
+	db := testQueueDB(t)
+	queue := newJobQueue(db, 100, 1, log.New(io.Discard, "", 0))
+	setFrequencyCaps(t, FrequencyCaps{
+		Categories: map[string][]string{"dropoff": {"PAN_FORM_DROPOFF", "VKYC_DROPOFF"}},
+		Exempt:     []string{"ARN_GENERATED"},
+		Caps: []FrequencyCap{
+			{Period: "day", Max: 2},
+			{Period: "day", Max: 1, Channel: "sms"},
+			{Period: "week", Max: 3, Category: "dropoff", Policy: capDrop},
+		},
+	})
+
+	now := ist(4, 12, 0) // Wednesday
+	dayEnd, weekEnd := ist(5, 0, 0), ist(9, 0, 0)
+	// User 1: one push today, one yesterday; only the daily all-channel cap has room left
+	insertSentHistory(t, queue, 1, "PAN_FORM_DROPOFF", "push", ist(4, 9, 0), ist(3, 9, 0))
+	// User 2: an exempt SMS today still counts towards the SMS cap
+	insertSentHistory(t, queue, 2, "ARN_GENERATED", "sms", ist(4, 9, 0))
+	// User 3: two messages today and three dropoffs this week, the last week's ones not counting
+	insertSentHistory(t, queue, 3, "VKYC_DROPOFF", "push", ist(4, 8, 0), ist(4, 9, 0), ist(2, 0, 0), ist(1, 23, 0), ist(1, 22, 0))
+
+	tests := []struct {
+		name       string
+		userID     uint32
+		event      string
+		channel    string
+		wantCapped bool
+		wantPolicy string
+		wantUntil  time.Time
+	}{
+		{"under every cap", 1, "PAN_FORM_DROPOFF", "push", false, "", time.Time{}},
+		{"channel cap reached", 2, "PAN_FORM_DROPOFF", "sms", true, capDefer, dayEnd},
+		{"other channel unaffected", 2, "PAN_FORM_DROPOFF", "push", false, "", time.Time{}},
+		{"exempt event never capped", 2, "ARN_GENERATED", "sms", false, "", time.Time{}},
+		{"drop wins over defer", 3, "PAN_FORM_DROPOFF", "push", true, capDrop, weekEnd},
+		{"other category only deferred", 3, "CREDIT_CARD_REJECTED", "push", true, capDefer, dayEnd},
+		{"no history", 4, "PAN_FORM_DROPOFF", "sms", false, "", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, until, capped, err := checkFrequencyCaps(db, Notification{UserID: tt.userID, Event: tt.event, Channel: tt.channel}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capped != tt.wantCapped || limit.Policy != tt.wantPolicy || !until.Equal(tt.wantUntil) {
+				t.Errorf("checkFrequencyCaps = %s (%s) until %s, capped %t; want %s until %s, capped %t",
+					limit, limit.Policy, until, capped, tt.wantPolicy, tt.wantUntil, tt.wantCapped)
+			}
+		})
+	}
+}
+
+func TestReleaseDefersOrDropsCappedJobs(t *testing.T) {
+	db := testQueueDB(t)
+	logger := log.New(io.Discard, "", 0)
+	queue := newJobQueue(db, 100, 1, logger)
+	setFrequencyCaps(t, FrequencyCaps{
+		Categories: map[string][]string{"dropoff": {"VKYC_DROPOFF"}},
+		Caps: []FrequencyCap{
+			{Period: "day", Max: 1, Channel: "push"},
+			{Period: "day", Max: 1, Category: "dropoff", Policy: capDrop},
+		},
+	})
+	insertSentHistory(t, queue, 1, "PAN_FORM_DROPOFF", "push", time.Now())
+	insertSentHistory(t, queue, 2, "VKYC_DROPOFF", "push", time.Now())
+	deferred := enqueueTestJob(t, queue, 1, "PAN_FORM_DROPOFF")
+	dropped := enqueueTestJob(t, queue, 2, "VKYC_DROPOFF")
+
+	sender := &captureSender{}
+	dispatcher := newDispatcher(logger)
+	dispatcher.Register("push", sender)
+	if _, errs := queue.Release(context.Background(), dispatcher, time.Now()); len(errs) > 0 {
+		t.Fatalf("Release errors: %v", errs)
+	}
+	if len(sender.sent) != 0 {
+		t.Fatalf("sent %d capped notifications", len(sender.sent))
+	}
+
+	_, tomorrow := FrequencyCap{Period: "day"}.period(time.Now())
+	for _, tt := range []struct {
+		key       string
+		wantState string
+		wantAt    time.Time
+	}{
+		{deferred.IdempotencyKey, jobPending, tomorrow},
+		{dropped.IdempotencyKey, jobCapped, dropped.ScheduledAt},
+	} {
+		var job struct {
+			State       string
+			Tries       int
+			ScheduledAt time.Time
+		}
+		if err := db.Raw(`SELECT state, tries, scheduled_at FROM notification_jobs WHERE idempotency_key = ?`, tt.key).Scan(&job).Error; err != nil {
+			t.Fatal(err)
+		}
+		if job.State != tt.wantState || job.Tries != 0 || job.ScheduledAt.Sub(tt.wantAt).Abs() > time.Second {
+			t.Errorf("job %s: %s, %d tries, scheduled at %s; want %s, 0 tries, scheduled at %s",
+				tt.key, job.State, job.Tries, job.ScheduledAt, tt.wantState, tt.wantAt)
+		}
+	}
+}
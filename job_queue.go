@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Scheduled job states in notification_jobs.state
+const (
+	jobPending    = "pending"
+	jobProcessing = "processing" // Claimed by a worker; reclaimed once the lease expires
+	jobSent       = "sent"
+	jobFailed     = "failed"
+	jobSuperseded = "superseded" // Cancelled by the pre-send re-validation
+	jobSuppressed = "suppressed" // Cancelled by cross-journey arbitration
+	jobCapped     = "capped"     // Cancelled by a frequency cap
+)
+
+// notificationJob is a claimed row of notification_jobs
+type notificationJob struct {
+	ID          int64
+	UserID      int64 // Routes the job to a send worker; zero for jobs queued before user_id was stored
+	ScheduledAt time.Time
+	Payload     []byte // Notification JSON
+	Tries       int    // Failed deliveries so far
+}
+
+// jobQueue is the Postgres-backed delayed delivery queue in notification_jobs
+type jobQueue struct {
+	db        *gorm.DB
+	claimSize int           // Jobs claimed per round trip
+	lease     time.Duration // How long a claimed job may stay processing before another worker reclaims it
+	maxTries  int           // Deliveries tried before a job is marked failed
+	backoff   time.Duration // Wait before a failed job is tried again, multiplied by its tries
+	workers   int           // Claimed jobs delivered concurrently
+	logger    *log.Logger
+}
+
+// newJobQueue creates a queue claiming up to claimSize due jobs at a time and delivering them with sendWorkers
+// workers; failed deliveries are tried JOB_MAX_TRIES times (default 3)
+func newJobQueue(db *gorm.DB, claimSize, sendWorkers int, logger *log.Logger) *jobQueue {
+	if claimSize <= 0 {
+		claimSize = 100
+	}
+	if sendWorkers <= 0 {
+		sendWorkers = 1
+	}
+	return &jobQueue{
+		db:        db,
+		claimSize: claimSize,
+		workers:   sendWorkers,
+		lease:     10 * time.Minute,
+		maxTries:  intFromEnv("JOB_MAX_TRIES", 3),
+		backoff:   5 * time.Minute,
+		logger:    logger,
+	}
+}
+
+// jobKey identifies a notification so re-scanning a candidate does not enqueue it twice
+func jobKey(notification Notification) string {
+	return fmt.Sprintf("%d:%s:%d", notification.UserID, notification.Event, notification.Attempt)
+}
+
+// Enqueue stores the notifications as pending jobs due at their scheduled time and returns how many were new
+func (q *jobQueue) Enqueue(notifications []Notification) (int, error) {
+	enqueued := 0
+	for _, notification := range notifications {
+		payload, err := json.Marshal(notification)
+		if err != nil {
+			return enqueued, fmt.Errorf("error encoding notification for user_id %d, event %s: %v", notification.UserID, notification.Event, err)
+		}
+		// Skips notifications already waiting (job_key) or already queued once (idempotency_key)
+		result := q.db.Exec(`INSERT INTO notification_jobs (job_key, idempotency_key, user_id, event_name, scheduled_at, payload, state)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT DO NOTHING`,
+			jobKey(notification), notification.IdempotencyKey, notification.UserID, notification.Event, notification.ScheduledAt, payload, jobPending)
+		if result.Error != nil {
+			log.Printf("Error enqueueing notification for user_id %d, event %s: %v", notification.UserID, notification.Event, result.Error)
+			return enqueued, fmt.Errorf("error enqueueing notification for user_id %d, event %s: %v", notification.UserID, notification.Event, result.Error)
+		}
+		enqueued += int(result.RowsAffected)
+	}
+	q.logger.Printf("Enqueued notifications: total=%d, new=%d", len(notifications), enqueued)
+	return enqueued, nil
+}
+
+// claimDue marks up to claimSize due jobs as processing, skipping rows other workers have locked
+func (q *jobQueue) claimDue() ([]notificationJob, error) {
+	var jobs []notificationJob
+	err := q.db.Raw(`UPDATE notification_jobs SET state = ?, locked_at = NOW(), updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM notification_jobs
+			WHERE scheduled_at <= NOW()
+			AND (state = ? OR (state = ? AND locked_at < ?))
+			ORDER BY scheduled_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, COALESCE(user_id, 0) AS user_id, scheduled_at, payload, tries`,
+		jobProcessing, jobPending, jobProcessing, time.Now().Add(-q.lease), q.claimSize).
+		Scan(&jobs).Error
+	if err != nil {
+		log.Printf("Error claiming due notification jobs: %v", err)
+		return nil, fmt.Errorf("error claiming due notification jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// complete stores the delivery outcome of a claimed job; a failed job goes back to pending with a backoff
+// until it has been tried maxTries times, except when its device token is invalid
+func (q *jobQueue) complete(job notificationJob, result DeliveryResult) error {
+	state, lastError, tries, scheduledAt := jobSent, "", job.Tries, job.ScheduledAt
+	switch result.Status {
+	case deliverySent:
+	case deliverySuperseded:
+		state = jobSuperseded
+	case deliverySuppressed:
+		state = jobSuppressed
+	case deliveryCapped:
+		state = jobCapped
+	case deliveryDeferred:
+		state, scheduledAt = jobPending, result.Notification.ScheduledAt
+	default:
+		tries++
+		state = jobFailed
+		var invalid *InvalidTokenError
+		if errors.As(result.Err, &invalid) {
+			// The token will never work again, so retrying would only report it again
+			q.logger.Printf("Not retrying notification job %d: %v", job.ID, invalid)
+		} else if tries < q.maxTries {
+			state, scheduledAt = jobPending, time.Now().Add(time.Duration(tries)*q.backoff)
+			q.logger.Printf("Retrying notification job %d at %s (try %d of %d)", job.ID, scheduledAt.Format(time.RFC3339), tries+1, q.maxTries)
+		}
+	}
+	if result.Err != nil {
+		lastError = result.Err.Error()
+	}
+	err := q.db.Exec(`UPDATE notification_jobs SET state = ?, last_error = ?, tries = ?, scheduled_at = ?, locked_at = NULL, updated_at = NOW() WHERE id = ?`,
+		state, lastError, tries, scheduledAt, job.ID).Error
+	if err != nil {
+		log.Printf("Error completing notification job %d: %v", job.ID, err)
+		return fmt.Errorf("error completing notification job %d: %v", job.ID, err)
+	}
+	return nil
+}
+
+// unclaim returns a claimed job to pending without delivering it
+func (q *jobQueue) unclaim(job notificationJob) error {
+	err := q.db.Exec(`UPDATE notification_jobs SET state = ?, locked_at = NULL, updated_at = NOW() WHERE id = ?`,
+		jobPending, job.ID).Error
+	if err != nil {
+		log.Printf("Error returning notification job %d to the queue: %v", job.ID, err)
+		return fmt.Errorf("error returning notification job %d to the queue: %v", job.ID, err)
+	}
+	return nil
+}
+
+// reschedule returns a claimed job to pending with a new due time
+func (q *jobQueue) reschedule(job notificationJob, scheduledAt time.Time) error {
+	err := q.db.Exec(`UPDATE notification_jobs SET state = ?, scheduled_at = ?, locked_at = NULL, updated_at = NOW() WHERE id = ?`,
+		jobPending, scheduledAt, job.ID).Error
+	if err != nil {
+		log.Printf("Error rescheduling notification job %d: %v", job.ID, err)
+		return fmt.Errorf("error rescheduling notification job %d: %v", job.ID, err)
+	}
+	return nil
+}
+
+// nextDue returns when the earliest pending job is due, or false when none is pending
+func (q *jobQueue) nextDue() (time.Time, bool, error) {
+	var next struct {
+		ScheduledAt *time.Time
+	}
+	err := q.db.Raw(`SELECT MIN(scheduled_at) AS scheduled_at FROM notification_jobs WHERE state = ?`, jobPending).
+		Scan(&next).Error
+	if err != nil {
+		log.Printf("Error fetching next due notification job: %v", err)
+		return time.Time{}, false, fmt.Errorf("error fetching next due notification job: %v", err)
+	}
+	if next.ScheduledAt == nil {
+		return time.Time{}, false, nil
+	}
+	return *next.ScheduledAt, true, nil
+}
+
+// revalidate runs the pre-send checks of a claimed job and returns its result when it must not be sent now:
+// superseded by the user's progress in the journey, suppressed by another journey's message, capped or deferred
+// by a frequency cap, or failed (and so retried) when a check could not run
+func (q *jobQueue) revalidate(job notificationJob, notification Notification, dispatcher *Dispatcher) (DeliveryResult, bool) {
+	status, err := supersededBy(q.db, notification)
+	if err != nil {
+		return DeliveryResult{Notification: notification, Status: deliveryFailed, Err: err}, true
+	}
+	if status != "" {
+		return dispatcher.cancel(notification, deliverySuperseded, status), true
+	}
+	winner, err := arbitrate(q.db, job, notification)
+	if err != nil {
+		return DeliveryResult{Notification: notification, Status: deliveryFailed, Err: err}, true
+	}
+	if winner != "" {
+		return dispatcher.cancel(notification, deliverySuppressed, winner), true
+	}
+	limit, until, capped, err := checkFrequencyCaps(q.db, notification, time.Now())
+	if err != nil {
+		return DeliveryResult{Notification: notification, Status: deliveryFailed, Err: err}, true
+	}
+	if capped && limit.Policy == capDrop {
+		return dispatcher.cancel(notification, deliveryCapped, limit.String()), true
+	}
+	if capped {
+		return dispatcher.deferUntil(notification, until, "frequency cap "+limit.String()), true
+	}
+	return DeliveryResult{}, false
+}
+
+// alreadySent reports whether notification_status has a sent row with the notification's idempotency key, left
+// by a worker that crashed after the provider accepted the notification but before the job was completed
+func (q *jobQueue) alreadySent(notification Notification) (bool, error) {
+	var sent bool
+	err := q.db.Raw(`SELECT EXISTS (SELECT 1 FROM notification_status WHERE idempotency_key = ? AND status = ?)`,
+		notification.IdempotencyKey, deliverySent).Scan(&sent).Error
+	if err != nil {
+		log.Printf("Error checking whether notification %s was sent: %v", notification.IdempotencyKey, err)
+		return false, fmt.Errorf("error checking whether notification %s was sent: %v", notification.IdempotencyKey, err)
+	}
+	return sent, nil
+}
+
+// lazyConfigs loads notification_config on first use and shares it between the send workers
+type lazyConfigs struct {
+	db      *gorm.DB
+	mu      sync.Mutex
+	configs notificationConfigs
+}
+
+// get returns the loaded notification_config, loading it on the first call
+func (c *lazyConfigs) get() (notificationConfigs, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.configs == nil {
+		configs, err := loadNotificationConfigs(c.db)
+		if err != nil {
+			return nil, err
+		}
+		c.configs = configs
+	}
+	return c.configs, nil
+}
+
+// advance queues the next attempt of a sent notification, loading notification_config on first use
+func (q *jobQueue) advance(sent Notification, configs *lazyConfigs, dispatcher *Dispatcher) error {
+	loaded, err := configs.get()
+	if err != nil {
+		return err
+	}
+	return q.followUp(sent, loaded, dispatcher)
+}
+
+// followUp queues the next attempt of a sent notification, no sooner than the event's min_spacing, or records the
+// user as exhausted when the sent attempt was the last one allowed by max_attempts or notification_config
+func (q *jobQueue) followUp(sent Notification, configs notificationConfigs, dispatcher *Dispatcher) error {
+	if sent.AnchorAt.IsZero() {
+		return nil
+	}
+	limit := attemptLimits.forEvent(sent.Event)
+	notificationConfig, ok := configs.lookup(sent.Event, sent.Attempt+1)
+	if !ok || limit.exhausted(sent.Attempt) {
+		return dispatcher.exhaust(sent).RecordErr
+	}
+	next := nextAttempt(sent, notificationConfig)
+	_, err := q.Enqueue([]Notification{limit.spaced(next, time.Now())})
+	return err
+}
+
+// Release delivers due jobs through the dispatcher until none is due before the deadline or ctx is cancelled;
+// every sent notification queues its next attempt
+func (q *jobQueue) Release(ctx context.Context, dispatcher *Dispatcher, deadline time.Time) ([]DeliveryResult, []error) {
+	var results []DeliveryResult
+	var errs []error
+	configs := &lazyConfigs{db: q.db} // Loaded on the first successful send
+	for ctx.Err() == nil {
+		jobs, err := q.claimDue()
+		if err != nil {
+			return results, append(errs, err)
+		}
+
+		claimedResults, claimedErrs := q.deliverClaimed(ctx, jobs, dispatcher, configs)
+		results = append(results, claimedResults...)
+		errs = append(errs, claimedErrs...)
+		if len(jobs) == q.claimSize {
+			continue
+		}
+
+		// Sleep until the next pending job if it falls due before the deadline
+		next, ok, err := q.nextDue()
+		if err != nil {
+			return results, append(errs, err)
+		}
+		if !ok || next.After(deadline) {
+			break
+		}
+		if err := sleepUntil(ctx, next); err != nil {
+			break
+		}
+	}
+
+	dispatcher.logSummary(results)
+	return results, errs
+}
+
+// deliverClaimed releases claimed jobs with the queue's send workers. All jobs of a user go to the same worker in
+// claim order, so arbitration and frequency caps see the user's previous send before checking the next job
+func (q *jobQueue) deliverClaimed(ctx context.Context, jobs []notificationJob, dispatcher *Dispatcher, configs *lazyConfigs) ([]DeliveryResult, []error) {
+	var mu sync.Mutex
+	var results []DeliveryResult
+	var errs []error
+
+	// Jobs keep the contact details of when they were built; a rotated device token or changed email is looked up
+	// once for the claimed batch. When the lookup fails the queued details are used
+	userIDs := make([]uint32, 0, len(jobs))
+	for _, job := range jobs {
+		if job.UserID != 0 {
+			userIDs = append(userIDs, uint32(job.UserID))
+		}
+	}
+	contacts, err := fetchContactDetails(q.db, userIDs)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	queues := make([]chan notificationJob, q.workers)
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan notificationJob, len(jobs))
+		workers.Add(1)
+		go func(jobs <-chan notificationJob) {
+			defer workers.Done()
+			for job := range jobs {
+				result, jobErrs := q.releaseJob(ctx, job, contacts, dispatcher, configs)
+				mu.Lock()
+				if result != nil {
+					results = append(results, *result)
+				}
+				errs = append(errs, jobErrs...)
+				mu.Unlock()
+			}
+		}(queues[i])
+	}
+	for _, job := range jobs {
+		queues[job.UserID%int64(len(queues))] <- job
+	}
+	for _, jobs := range queues {
+		close(jobs)
+	}
+	workers.Wait()
+	return results, errs
+}
+
+// releaseJob re-checks and delivers one claimed job with the user's current contact details and queues its next
+// attempt once sent; the result is nil when the job went back to the queue without a delivery decision
+func (q *jobQueue) releaseJob(ctx context.Context, job notificationJob, contacts contactDetails, dispatcher *Dispatcher, configs *lazyConfigs) (*DeliveryResult, []error) {
+	var errs []error
+	// Hand jobs claimed before a shutdown back to the queue instead of failing them
+	if ctx.Err() != nil {
+		if err := q.unclaim(job); err != nil {
+			errs = append(errs, err)
+		}
+		return nil, errs
+	}
+
+	var notification Notification
+	if err := json.Unmarshal(job.Payload, &notification); err != nil {
+		err = fmt.Errorf("error decoding notification job %d: %v", job.ID, err)
+		errs = append(errs, err)
+		if err := q.complete(job, DeliveryResult{Status: deliveryFailed, Err: err}); err != nil {
+			errs = append(errs, err)
+		}
+		return nil, errs
+	}
+	// Jobs queued before notifications carried a key get the one their scan would derive now
+	if notification.IdempotencyKey == "" {
+		notification.IdempotencyKey = idempotencyKey(notification.UserID, notification.Event, notification.Attempt, notification.AnchorAt)
+	}
+	// Providers without idempotency support (FCM, WhatsApp) would deliver a reclaimed job twice
+	sent, err := q.alreadySent(notification)
+	if err != nil {
+		// The delivery was never tried, so retry after the backoff without spending one of the job's tries
+		retryAt := time.Now().Add(q.backoff)
+		q.logger.Printf("Retrying notification job %d at %s: %v", job.ID, retryAt.Format(time.RFC3339), err)
+		if err := q.reschedule(job, retryAt); err != nil {
+			errs = append(errs, err)
+		}
+		return nil, append(errs, err)
+	}
+	if sent {
+		q.logger.Printf("Notification job %d for user_id %d, event %s, attempt %d was already sent, completing it",
+			job.ID, notification.UserID, notification.Event, notification.Attempt)
+		if err := q.complete(job, DeliveryResult{Notification: notification, Status: deliverySent}); err != nil {
+			errs = append(errs, err)
+		}
+		if err := q.advance(notification, configs, dispatcher); err != nil {
+			errs = append(errs, err)
+		}
+		return nil, errs
+	}
+	notification = notification.withContact(contacts)
+
+	// Jobs released late (e.g. after downtime) still respect quiet hours
+	now := time.Now()
+	if allowed := sendWindows.windowFor(notification.Channel, notification.Event).next(now); allowed.After(now) {
+		q.logger.Printf("Holding notification for user_id %d, event %s until %s: outside send window",
+			notification.UserID, notification.Event, allowed.Format(time.RFC3339))
+		if err := q.reschedule(job, allowed); err != nil {
+			errs = append(errs, err)
+		}
+		return nil, errs
+	}
+
+	// Cancel or hold nudges the user has moved past, that lose to another journey's message or exceed a cap
+	if result, cancelled := q.revalidate(job, notification, dispatcher); cancelled {
+		if err := q.complete(job, result); err != nil {
+			errs = append(errs, err)
+		}
+		return &result, errs
+	}
+
+	// A send that has started is finished even when shutdown is requested meanwhile
+	result := dispatcher.deliver(context.WithoutCancel(ctx), notification)
+	if err := q.complete(job, result); err != nil {
+		errs = append(errs, err)
+	}
+	if result.Status == deliverySent {
+		if err := q.advance(notification, configs, dispatcher); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return &result, errs
+}
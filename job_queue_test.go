@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// testQueueDB is testDB with custom_headers, notification_config and the comms tables of migrations/
+func testQueueDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := testDB(t)
+	if err := db.Exec(`CREATE TABLE custom_headers (user_id BIGINT, x_platform TEXT, x_device_token TEXT, updated_at TIMESTAMPTZ);
+		CREATE TABLE notification_config (event_name TEXT, event_id INTEGER, attempt INTEGER, delay INTEGER, channel TEXT)`).Error; err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := filepath.Glob("migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range migrations {
+		migration, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec(string(migration)).Error; err != nil {
+			t.Fatalf("error applying %s: %v", path, err)
+		}
+	}
+	return db
+}
+
+// enqueueTestJob queues a due push notification for the user and returns it
+func enqueueTestJob(t *testing.T, queue *jobQueue, userID uint32, event string) Notification {
+	t.Helper()
+	anchorAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	notification := Notification{
+		UserID:      userID,
+		Event:       event,
+		Attempt:     1,
+		Channel:     "push",
+		AnchorAt:    anchorAt,
+		ScheduledAt: time.Now().Add(-time.Minute),
+	}
+	notification.IdempotencyKey = idempotencyKey(userID, event, 1, anchorAt)
+	if _, err := queue.Enqueue([]Notification{notification}); err != nil {
+		t.Fatal(err)
+	}
+	return notification
+}
+
+// barrierSender holds every Send until want sends are in flight at once, failing them when that never happens
+type barrierSender struct {
+	want    int
+	mu      sync.Mutex
+	waiting int
+	all     chan struct{}
+}
+
+func (s *barrierSender) Name() string { return "barrier" }
+
+func (s *barrierSender) Send(ctx context.Context, notification Notification) (string, error) {
+	s.mu.Lock()
+	s.waiting++
+	if s.waiting == s.want {
+		close(s.all)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.all:
+		return "barrier-1", nil
+	case <-time.After(5 * time.Second):
+		return "", context.DeadlineExceeded
+	}
+}
+
+func TestReleaseDeliversWithSendWorkers(t *testing.T) {
+	db := testQueueDB(t)
+	logger := log.New(io.Discard, "", 0)
+	const workers = 4
+	queue := newJobQueue(db, 100, workers, logger)
+	for userID := uint32(1); userID <= workers; userID++ {
+		enqueueTestJob(t, queue, userID, "PAN_FORM_DROPOFF")
+	}
+
+	// Each send waits for the others, so a single serial worker would fail them all
+	dispatcher := newDispatcher(logger)
+	dispatcher.Register("push", &barrierSender{want: workers, all: make(chan struct{})})
+	results, errs := queue.Release(context.Background(), dispatcher, time.Now())
+	if len(errs) > 0 {
+		t.Fatalf("Release errors: %v", errs)
+	}
+	if len(results) != workers {
+		t.Fatalf("Release returned %d results, want %d", len(results), workers)
+	}
+	for _, result := range results {
+		if result.Status != deliverySent {
+			t.Errorf("user_id %d: status %s (%v), want sent", result.Notification.UserID, result.Status, result.Err)
+		}
+	}
+}
+
+// captureSender records the notifications it is asked to send
+type captureSender struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (s *captureSender) Name() string { return "capture" }
+
+func (s *captureSender) Send(ctx context.Context, notification Notification) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, notification)
+	return "capture-1", nil
+}
+
+func TestReleaseUsesCurrentContactDetails(t *testing.T) {
+	db := testQueueDB(t)
+	logger := log.New(io.Discard, "", 0)
+	queue := newJobQueue(db, 100, 1, logger)
+
+	// Queued with the details of when attempt 1 was sent; the user has since rotated their token and changed email
+	enqueueTestJob(t, queue, 7, "PAN_FORM_DROPOFF")
+	if err := db.Exec(`UPDATE notification_jobs SET payload = jsonb_set(jsonb_set(payload, '{device_token}', '"old-token"'), '{email}', '"old@example.com"')`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO users (id, mobile_number, full_name, plain_mobile_number, email) VALUES (7, '9800000007', 'Asha', '9800000007', 'new@example.com');
+		INSERT INTO custom_headers (user_id, x_platform, x_device_token, updated_at) VALUES
+			(7, 'android', 'old-token', NOW() - INTERVAL '2 days'),
+			(7, 'ios', 'new-token', NOW() - INTERVAL '1 hour')`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &captureSender{}
+	dispatcher := newDispatcher(logger)
+	dispatcher.Register("push", sender)
+	if _, errs := queue.Release(context.Background(), dispatcher, time.Now()); len(errs) > 0 {
+		t.Fatalf("Release errors: %v", errs)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("sent %d notifications, want 1", len(sender.sent))
+	}
+	sent := sender.sent[0]
+	if sent.DeviceToken != "new-token" || sent.Platform != "ios" || sent.Email != "new@example.com" || sent.Metadata["Name"] != "Asha" {
+		t.Errorf("sent with token %s (%s), email %s, name %s; want the current new-token (ios), new@example.com, Asha",
+			sent.DeviceToken, sent.Platform, sent.Email, sent.Metadata["Name"])
+	}
+}
+
+// queuedJob is the stored state of a notification job
+type queuedJob struct {
+	State       string
+	Tries       int
+	ScheduledAt time.Time
+	LockedAt    *time.Time
+	LastError   string
+}
+
+// loadJob reads the stored state of the job with the idempotency key
+func loadJob(t *testing.T, db *gorm.DB, key string) queuedJob {
+	t.Helper()
+	var job queuedJob
+	if err := db.Raw(`SELECT state, tries, scheduled_at, locked_at, last_error FROM notification_jobs WHERE idempotency_key = ?`, key).Scan(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// claimOne claims the due jobs and returns the one with the idempotency key
+func claimOne(t *testing.T, queue *jobQueue, key string) notificationJob {
+	t.Helper()
+	jobs, err := queue.claimDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		var notification Notification
+		if err := json.Unmarshal(job.Payload, &notification); err != nil {
+			t.Fatal(err)
+		}
+		if notification.IdempotencyKey == key {
+			return job
+		}
+	}
+	t.Fatalf("job %s was not claimed", key)
+	return notificationJob{}
+}
+
+func TestClaimDueClaimsDuePendingAndExpiredJobs(t *testing.T) {
+	db := testQueueDB(t)
+	queue := newJobQueue(db, 100, 1, log.New(io.Discard, "", 0))
+	due := enqueueTestJob(t, queue, 1, "PAN_FORM_DROPOFF")
+	later := enqueueTestJob(t, queue, 2, "PAN_FORM_DROPOFF")
+	expired := enqueueTestJob(t, queue, 3, "PAN_FORM_DROPOFF")
+	leased := enqueueTestJob(t, queue, 4, "PAN_FORM_DROPOFF")
+	sent := enqueueTestJob(t, queue, 5, "PAN_FORM_DROPOFF")
+	if err := db.Exec(`UPDATE notification_jobs SET scheduled_at = NOW() + INTERVAL '1 hour' WHERE idempotency_key = ?;
+		UPDATE notification_jobs SET state = 'processing', locked_at = NOW() - INTERVAL '11 minutes' WHERE idempotency_key = ?;
+		UPDATE notification_jobs SET state = 'processing', locked_at = NOW() - INTERVAL '1 minute' WHERE idempotency_key = ?;
+		UPDATE notification_jobs SET state = 'sent' WHERE idempotency_key = ?`,
+		later.IdempotencyKey, expired.IdempotencyKey, leased.IdempotencyKey, sent.IdempotencyKey).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := queue.claimDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed := make(map[int64]bool)
+	for _, job := range jobs {
+		claimed[job.UserID] = true
+	}
+	if len(jobs) != 2 || !claimed[1] || !claimed[3] {
+		t.Errorf("claimed the jobs of users %v, want the due job of user 1 and the expired lease of user 3", claimed)
+	}
+	for _, key := range []string{due.IdempotencyKey, expired.IdempotencyKey} {
+		if job := loadJob(t, db, key); job.State != jobProcessing || job.LockedAt == nil || time.Since(*job.LockedAt) > time.Minute {
+			t.Errorf("claimed job %s: %s, locked at %v", key, job.State, job.LockedAt)
+		}
+	}
+	if jobs, err := queue.claimDue(); err != nil || len(jobs) != 0 {
+		t.Errorf("second claim = %d jobs, %v; want none", len(jobs), err)
+	}
+}
+
+func TestCompleteStateTransitions(t *testing.T) {
+	db := testQueueDB(t)
+	queue := newJobQueue(db, 100, 1, log.New(io.Discard, "", 0))
+	queue.maxTries = 3
+	failure := errors.New("provider unavailable")
+
+	tests := []struct {
+		name      string
+		tries     int
+		result    DeliveryResult
+		wantState string
+		wantTries int
+		wantAt    func(job notificationJob) time.Time // Expected scheduled_at
+	}{
+		{"sent", 0, DeliveryResult{Status: deliverySent}, jobSent, 0, func(job notificationJob) time.Time { return job.ScheduledAt }},
+		{"first failure retried", 0, DeliveryResult{Status: deliveryFailed, Err: failure}, jobPending, 1,
+			func(notificationJob) time.Time { return time.Now().Add(queue.backoff) }},
+		{"second failure backs off longer", 1, DeliveryResult{Status: deliveryFailed, Err: failure}, jobPending, 2,
+			func(notificationJob) time.Time { return time.Now().Add(2 * queue.backoff) }},
+		{"failed after max tries", 2, DeliveryResult{Status: deliveryFailed, Err: failure}, jobFailed, 3,
+			func(job notificationJob) time.Time { return job.ScheduledAt }},
+		{"invalid token not retried", 0, DeliveryResult{Status: deliveryFailed, Err: &InvalidTokenError{UserID: 1, Token: "t", Reason: "UNREGISTERED"}}, jobFailed, 1,
+			func(job notificationJob) time.Time { return job.ScheduledAt }},
+		{"deferred keeps its tries", 1, DeliveryResult{Status: deliveryDeferred, Notification: Notification{ScheduledAt: time.Now().Add(6 * time.Hour)}}, jobPending, 1,
+			func(notificationJob) time.Time { return time.Now().Add(6 * time.Hour) }},
+		{"capped", 0, DeliveryResult{Status: deliveryCapped}, jobCapped, 0, func(job notificationJob) time.Time { return job.ScheduledAt }},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notification := enqueueTestJob(t, queue, uint32(100+i), "PAN_FORM_DROPOFF")
+			if err := db.Exec(`UPDATE notification_jobs SET tries = ? WHERE idempotency_key = ?`, tt.tries, notification.IdempotencyKey).Error; err != nil {
+				t.Fatal(err)
+			}
+			job := claimOne(t, queue, notification.IdempotencyKey)
+			if err := queue.complete(job, tt.result); err != nil {
+				t.Fatal(err)
+			}
+			stored := loadJob(t, db, notification.IdempotencyKey)
+			if stored.State != tt.wantState || stored.Tries != tt.wantTries || stored.LockedAt != nil {
+				t.Errorf("job after complete: %s, %d tries, locked at %v; want %s, %d tries, unlocked", stored.State, stored.Tries, stored.LockedAt, tt.wantState, tt.wantTries)
+			}
+			if want := tt.wantAt(job); stored.ScheduledAt.Sub(want).Abs() > 5*time.Second {
+				t.Errorf("job scheduled at %s, want about %s", stored.ScheduledAt, want)
+			}
+			if tt.result.Err != nil && stored.LastError != tt.result.Err.Error() {
+				t.Errorf("last_error = %q, want %q", stored.LastError, tt.result.Err.Error())
+			}
+		})
+	}
+}
+
+func TestReleaseRetriesAlreadySentErrorsWithoutSpendingATry(t *testing.T) {
+	db := testQueueDB(t)
+	logger := log.New(io.Discard, "", 0)
+	queue := newJobQueue(db, 100, 1, logger)
+	notification := enqueueTestJob(t, queue, 1, "PAN_FORM_DROPOFF")
+	// The sent check fails on a missing notification_status table
+	if err := db.Exec(`ALTER TABLE notification_status RENAME TO notification_status_unavailable`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &captureSender{}
+	dispatcher := newDispatcher(logger)
+	dispatcher.Register("push", sender)
+	if _, errs := queue.Release(context.Background(), dispatcher, time.Now()); len(errs) == 0 {
+		t.Error("Release did not report the failed sent check")
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("sent %d notifications without checking whether they were already sent", len(sender.sent))
+	}
+	job := loadJob(t, db, notification.IdempotencyKey)
+	if job.State != jobPending || job.Tries != 0 || job.LockedAt != nil || job.ScheduledAt.Sub(time.Now().Add(queue.backoff)).Abs() > 5*time.Second {
+		t.Errorf("job after a failed sent check: %s, %d tries, scheduled at %s, locked at %v; want pending, 0 tries, in %s",
+			job.State, job.Tries, job.ScheduledAt, job.LockedAt, queue.backoff)
+	}
+}
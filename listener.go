@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// listenChannel is the NOTIFY channel the insert triggers of migrations/008 publish on
+const listenChannel = "comms_events"
+
+// Inserts are collected for up to listenFlushInterval or listenBatchSize users and then classified together
+const (
+	listenFlushInterval = time.Second
+	listenBatchSize     = 500
+)
+
+// insertEvent is the NOTIFY payload of an insert into a journey table
+type insertEvent struct {
+	Table        string `json:"table"`
+	MobileNumber string `json:"mobile_number"`
+}
+
+// listen classifies the users of journey table inserts as they arrive and queues their notifications until ctx
+// is cancelled. Inserts missed while the listener is disconnected are picked up by the scheduled scans
+func listen(ctx context.Context, db *gorm.DB, journeys []EventSource, queue *jobQueue, options pipelineOptions, logger *log.Logger) {
+	events := make(chan insertEvent, listenBatchSize)
+	go func() {
+		defer close(events)
+		for ctx.Err() == nil {
+			if err := receiveInserts(ctx, events, logger); err != nil {
+				logger.Printf("Listener error, reconnecting in 5s: %v", err)
+				sleepUntil(ctx, time.Now().Add(5*time.Second))
+			}
+		}
+	}()
+
+	for event := range events {
+		mobilesByTable := make(map[string][]string)
+		seen := make(map[insertEvent]struct{})
+		add := func(event insertEvent) {
+			if _, exists := seen[event]; !exists {
+				mobilesByTable[event.Table] = append(mobilesByTable[event.Table], event.MobileNumber)
+				seen[event] = struct{}{}
+			}
+		}
+		add(event)
+
+		flush := time.After(listenFlushInterval)
+	collect:
+		for len(seen) < listenBatchSize {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					break collect
+				}
+				add(event)
+			case <-flush:
+				break collect
+			}
+		}
+		classifyInserts(db, journeys, mobilesByTable, queue, options, logger)
+	}
+}
+
+// receiveInserts forwards insert events from a dedicated LISTEN connection until ctx is cancelled or the
+// connection fails
+func receiveInserts(ctx context.Context, events chan<- insertEvent, logger *log.Logger) error {
+	conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return fmt.Errorf("error connecting listener: %v", err)
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+listenChannel); err != nil {
+		return fmt.Errorf("error listening on %s: %v", listenChannel, err)
+	}
+	logger.Printf("Listening for journey inserts on %s", listenChannel)
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error waiting for journey inserts: %v", err)
+		}
+		var event insertEvent
+		if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil || event.MobileNumber == "" {
+			logger.Printf("Ignoring journey insert event %q: %v", notification.Payload, err)
+			continue
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// classifyInserts runs every journey reading one of the inserted tables for just the inserted users, with the
+// same classification queries as the scheduled scans, and queues the resulting notifications
+func classifyInserts(db *gorm.DB, journeys []EventSource, mobilesByTable map[string][]string, queue *jobQueue,
+	options pipelineOptions, logger *log.Logger) {
+	configs, err := loadNotificationConfigs(db)
+	if err != nil {
+		logger.Printf("Listener error: %v", err)
+		return
+	}
+	report := newRunReport()
+	for _, source := range journeys {
+		triggered, ok := source.(tableSource)
+		if !ok || len(mobilesByTable[triggered.Table()]) == 0 {
+			continue
+		}
+		options.Mobiles = mobilesByTable[triggered.Table()]
+		logger.Printf("Classifying %d inserted users for journey %s", len(options.Mobiles), source.Name())
+		// Like scheduled scans, classification is finished on shutdown so nothing is half queued
+		errs := runSource(context.Background(), db, source, options, configs, report, func(notifications []Notification) error {
+			_, err := queue.Enqueue(notifications)
+			return err
+		}, logger)
+		for i, err := range errs {
+			logger.Printf("Journey %s error %d: %v", source.Name(), i+1, err)
+		}
+	}
+	report.log(logger)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+)
+
+// fetchInChunks splits keys into chunks of LOOKUP_CHUNK_SIZE (default 5000, far below Postgres's 65535 bind
+// parameters per query), runs fetch on up to LOOKUP_CONCURRENCY (default 4) chunks at a time and merges the results
+func fetchInChunks[T any, K comparable, V any](keys []T, fetch func(chunk []T) (map[K]V, error)) (map[K]V, error) {
+	chunkSize := intFromEnv("LOOKUP_CHUNK_SIZE", 5000)
+	merged := make(map[K]V, len(keys))
+	var mu sync.Mutex
+	var group errgroup.Group
+	group.SetLimit(intFromEnv("LOOKUP_CONCURRENCY", 4))
+	for start := 0; start < len(keys); start += chunkSize {
+		chunk := keys[start:min(start+chunkSize, len(keys))]
+		group.Go(func() error {
+			result, err := fetch(chunk)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for key, value := range result {
+				merged[key] = value
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// fetchUserDetails retrieves user details for multiple mobile numbers
+func fetchUserDetails(db *gorm.DB, mobileNumbers []string) (map[string]UserDetails, error) {
+	userDetailsMap, err := fetchInChunks(mobileNumbers, func(chunk []string) (map[string]UserDetails, error) {
+		var userDetails []UserDetails
+		err := db.Table("users").
+			Select("id, full_name, mobile_number, plain_mobile_number, email").
+			Where("mobile_number IN ?", chunk).
+			Scan(&userDetails).Error
+		if err != nil {
+			log.Printf("Error fetching user details for %d mobile numbers: %v", len(chunk), err)
+			return nil, fmt.Errorf("error fetching user details: %v", err)
+		}
+		chunkMap := make(map[string]UserDetails, len(userDetails))
+		for _, detail := range userDetails {
+			chunkMap[detail.MobileNumber] = detail
+		}
+		return chunkMap, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fetched user details: mobile_numbers=%d, found=%d", len(mobileNumbers), len(userDetailsMap))
+	return userDetailsMap, nil
+}
+
+// fetchCustomHeader retrieves the latest custom header for multiple user IDs
+func fetchCustomHeader(db *gorm.DB, userIDs []uint32) (map[uint32]CustomHeaderDetails, error) {
+	customHeadersMap, err := fetchInChunks(userIDs, func(chunk []uint32) (map[uint32]CustomHeaderDetails, error) {
+		var customHeaders []struct {
+			UserID       uint32
+			XPlatform    string
+			XDeviceToken string
+		}
+		err := db.Table("custom_headers").
+			Select("user_id, x_platform, x_device_token").
+			Where("user_id IN ?", chunk).
+			Order("user_id, updated_at DESC").
+			Scan(&customHeaders).Error
+		if err != nil {
+			log.Printf("Error fetching custom headers for %d user IDs: %v", len(chunk), err)
+			return nil, fmt.Errorf("error fetching custom headers: %v", err)
+		}
+		chunkMap := make(map[uint32]CustomHeaderDetails, len(customHeaders))
+		for _, header := range customHeaders {
+			if _, exists := chunkMap[header.UserID]; !exists {
+				chunkMap[header.UserID] = CustomHeaderDetails{
+					XPlatform:    header.XPlatform,
+					XDeviceToken: header.XDeviceToken,
+				}
+			}
+		}
+		return chunkMap, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fetched custom headers: user_ids=%d, found=%d", len(userIDs), len(customHeadersMap))
+	return customHeadersMap, nil
+}
+
+// contactDetails are the current users rows and latest custom headers of queued notifications' users
+type contactDetails struct {
+	users   map[uint32]UserDetails
+	headers map[uint32]CustomHeaderDetails
+}
+
+// fetchContactDetails retrieves the current contact details of users by id, so a notification queued hours or
+// days ago goes to today's email, phone number and device token
+func fetchContactDetails(db *gorm.DB, userIDs []uint32) (contactDetails, error) {
+	users, err := fetchInChunks(userIDs, func(chunk []uint32) (map[uint32]UserDetails, error) {
+		var userDetails []UserDetails
+		err := db.Table("users").
+			Select("id, full_name, mobile_number, plain_mobile_number, email").
+			Where("id IN ?", chunk).
+			Scan(&userDetails).Error
+		if err != nil {
+			log.Printf("Error fetching user details for %d user IDs: %v", len(chunk), err)
+			return nil, fmt.Errorf("error fetching user details: %v", err)
+		}
+		chunkMap := make(map[uint32]UserDetails, len(userDetails))
+		for _, detail := range userDetails {
+			chunkMap[detail.ID] = detail
+		}
+		return chunkMap, nil
+	})
+	if err != nil {
+		return contactDetails{}, err
+	}
+	headers, err := fetchCustomHeader(db, userIDs)
+	if err != nil {
+		return contactDetails{}, err
+	}
+	return contactDetails{users: users, headers: headers}, nil
+}
+
+// statusKey identifies the notification_status history of one user and event
+type statusKey struct {
+	UserID    uint32
+	EventName string
+}
+
+// fetchNotificationStatuses retrieves the latest sent notification status per user and event, one query per chunk of users
+func fetchNotificationStatuses(db *gorm.DB, userIDs []uint32, eventNames []string) (map[statusKey]NotificationStatusDetails, error) {
+	return fetchInChunks(userIDs, func(chunk []uint32) (map[statusKey]NotificationStatusDetails, error) {
+		var statuses []struct {
+			UserID    uint32
+			EventName string
+			Attempt   int
+			SentAt    time.Time
+		}
+		err := db.Raw(`
+			SELECT DISTINCT ON (user_id, event_name) user_id, event_name, attempt, COALESCE(sent_at, updated_at) AS sent_at
+			FROM notification_status
+			WHERE user_id IN ? AND event_name IN ? AND status = ?
+			ORDER BY user_id, event_name, updated_at DESC
+		`, chunk, eventNames, deliverySent).Scan(&statuses).Error
+		if err != nil {
+			log.Printf("Error fetching notification status for %d user IDs: %v", len(chunk), err)
+			return nil, fmt.Errorf("error fetching notification status: %v", err)
+		}
+
+		statusMap := make(map[statusKey]NotificationStatusDetails, len(statuses))
+		for _, status := range statuses {
+			statusMap[statusKey{UserID: status.UserID, EventName: status.EventName}] = NotificationStatusDetails{
+				EventName:  status.EventName,
+				Attempt:    status.Attempt,
+				LastSentAt: status.SentAt,
+			}
+		}
+		return statusMap, nil
+	})
+}
+
+// configKey identifies a notification_config row
+type configKey struct {
+	EventName string
+	Attempt   int
+}
+
+// notificationConfigs is the notification_config table loaded once per run
+type notificationConfigs map[configKey]NotificationConfigDetails
+
+// loadNotificationConfigs reads the whole notification_config table
+func loadNotificationConfigs(db *gorm.DB) (notificationConfigs, error) {
+	var rows []struct {
+		NotificationConfigDetails
+		Attempt int
+	}
+	err := db.Table("notification_config").
+		Select("delay, channel, event_name, event_id, dlt_template_id, catch_up_policy, catch_up_grace_seconds, attempt").
+		Scan(&rows).Error
+	if err != nil {
+		log.Printf("Error loading notification config: %v", err)
+		return nil, fmt.Errorf("error loading notification config: %v", err)
+	}
+
+	configs := make(notificationConfigs, len(rows))
+	for _, row := range rows {
+		if !validCatchUpPolicy(row.CatchUpPolicy) {
+			return nil, fmt.Errorf("notification config for event %s, attempt %d has unknown catch_up_policy %q", row.EventName, row.Attempt, row.CatchUpPolicy)
+		}
+		configs[configKey{EventName: row.EventName, Attempt: row.Attempt}] = row.NotificationConfigDetails
+	}
+	log.Printf("Loaded notification config: total=%d", len(configs))
+	return configs, nil
+}
+
+// lookup returns the config for an event and attempt
+func (c notificationConfigs) lookup(eventName string, attempt int) (NotificationConfigDetails, bool) {
+	config, ok := c[configKey{EventName: eventName, Attempt: attempt}]
+	return config, ok
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// manyCandidates exceeds Postgres's limit of 65535 bind parameters per query
+const manyCandidates = 70001
+
+func TestFetchInChunksMergesEveryKey(t *testing.T) {
+	keys := make([]int, manyCandidates)
+	for i := range keys {
+		keys[i] = i
+	}
+
+	var mu sync.Mutex
+	var sizes []int
+	merged, err := fetchInChunks(keys, func(chunk []int) (map[int]string, error) {
+		mu.Lock()
+		sizes = append(sizes, len(chunk))
+		mu.Unlock()
+		result := make(map[int]string, len(chunk))
+		for _, key := range chunk {
+			result[key] = fmt.Sprint(key)
+		}
+		return result, nil
+	})
+	if err != nil {
+		t.Fatalf("fetchInChunks: %v", err)
+	}
+
+	if len(sizes) != 15 {
+		t.Errorf("fetched %d chunks, want 15", len(sizes))
+	}
+	small := 0
+	for _, size := range sizes {
+		if size > 5000 {
+			t.Errorf("chunk of %d keys exceeds the default chunk size", size)
+		}
+		if size < 5000 {
+			small++
+		}
+	}
+	if small != 1 {
+		t.Errorf("chunk sizes %v, want a single partial chunk", sizes)
+	}
+	if len(merged) != manyCandidates {
+		t.Fatalf("merged %d keys, want %d", len(merged), manyCandidates)
+	}
+	for _, key := range keys {
+		if merged[key] != fmt.Sprint(key) {
+			t.Fatalf("key %d merged as %q", key, merged[key])
+		}
+	}
+}
+
+func TestFetchInChunksChunkSize(t *testing.T) {
+	t.Setenv("LOOKUP_CHUNK_SIZE", "30000")
+	t.Setenv("LOOKUP_CONCURRENCY", "1")
+	keys := make([]int, manyCandidates)
+
+	var sizes []int
+	_, err := fetchInChunks(keys, func(chunk []int) (map[int]bool, error) {
+		sizes = append(sizes, len(chunk))
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("fetchInChunks: %v", err)
+	}
+	if fmt.Sprint(sizes) != "[30000 30000 10001]" {
+		t.Errorf("chunk sizes %v, want [30000 30000 10001]", sizes)
+	}
+}
+
+func TestFetchInChunksReturnsChunkError(t *testing.T) {
+	keys := make([]int, manyCandidates)
+	for i := range keys {
+		keys[i] = i
+	}
+	for _, failing := range []int{0, 7, 14} {
+		t.Run(fmt.Sprintf("chunk %d", failing), func(t *testing.T) {
+			merged, err := fetchInChunks(keys, func(chunk []int) (map[int]bool, error) {
+				if chunk[0]/5000 == failing {
+					return nil, fmt.Errorf("chunk %d failed", failing)
+				}
+				return map[int]bool{chunk[0]: true}, nil
+			})
+			if err == nil || err.Error() != fmt.Sprintf("chunk %d failed", failing) {
+				t.Errorf("error = %v, want the failing chunk's error", err)
+			}
+			if merged != nil {
+				t.Errorf("merged %d keys despite the error", len(merged))
+			}
+		})
+	}
+}
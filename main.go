@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// usage prints the available subcommands
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: comms [flags] <journey>|all|serve|exhausted\n\nJourneys:\n")
+	for _, source := range sources {
+		fmt.Fprintf(os.Stderr, "  %s\n", source.Name())
+	}
+	fmt.Fprintf(os.Stderr, "  all\n\nserve runs every journey on its schedule and sends notifications as they fall due.\n")
+	fmt.Fprintf(os.Stderr, "exhausted lists the users sent every attempt of an event within -since who did not convert.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	// Initialize standard logger
+	logger := log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime)
+	loadEnv()
+
+	// Register the declarative journeys from the rules file
+	rules, err := loadRules(os.Getenv("RULES_FILE"))
+	if err != nil {
+		logger.Printf("Error loading journey rules: %v", err)
+		os.Exit(1)
+	}
+	registerRules(rules)
+
+	batchSize := flag.Int("batch-size", 1000, "Number of rows fetched per journey query")
+	dryRun := flag.Bool("dry-run", false, "Print notifications instead of sending them")
+	maxWait := flag.Duration("max-wait", time.Hour, "How long to keep releasing queued notifications as they fall due before exiting")
+	enrichWorkers := flag.Int("enrich-workers", 4, "Batches enriched concurrently per journey")
+	scheduleWorkers := flag.Int("schedule-workers", 2, "Notification batches queued concurrently per journey")
+	sendWorkers := flag.Int("send-workers", 4, "Due notifications delivered concurrently")
+	pollInterval := flag.Duration("poll-interval", 5*time.Second, "How often serve checks the queue for newly due notifications")
+	listenInserts := flag.Bool("listen", false, "With serve, also queue notifications as soon as flow_statuses, card_statuses and arns rows are inserted")
+	backfill := flag.Duration("backfill", 0, "Rescan this far back (e.g. 72h) instead of resuming each journey from its checkpoint")
+	since := flag.Duration("since", 7*24*time.Hour, "With exhausted, how far back to look for exhausted users")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Resolve the event sources to run
+	serveMode := flag.Arg(0) == "serve"
+	if serveMode && *dryRun {
+		fmt.Fprintf(os.Stderr, "serve cannot be combined with -dry-run\n")
+		os.Exit(2)
+	}
+	if *listenInserts && !serveMode {
+		fmt.Fprintf(os.Stderr, "-listen requires serve\n")
+		os.Exit(2)
+	}
+	if serveMode && *backfill > 0 {
+		fmt.Fprintf(os.Stderr, "serve cannot be combined with -backfill\n")
+		os.Exit(2)
+	}
+	exhaustedMode := flag.Arg(0) == "exhausted"
+	var selected []EventSource
+	if name := flag.Arg(0); name == "all" || serveMode {
+		selected = sources
+	} else if !exhaustedMode {
+		source, ok := findSource(name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown journey %q\n\n", name)
+			usage()
+			os.Exit(2)
+		}
+		selected = []EventSource{source}
+	}
+
+	// Connect to database
+	db, err := connectDB()
+	if err != nil {
+		logger.Printf("Error connecting to database: %v", err)
+		os.Exit(1)
+	}
+	if exhaustedMode {
+		if err := reportExhausted(db, time.Now().Add(-*since), logger); err != nil {
+			logger.Printf("Error reporting exhausted users: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Set up delivery; dry runs print every notification instead of sending it
+	dispatcher := newDispatcher(logger)
+	invalidTokens := &invalidTokenReport{}
+	if *dryRun {
+		dispatcher.SetDryRun(printSender{out: os.Stdout})
+	} else if err := configureSenders(db, dispatcher, invalidTokens); err != nil {
+		logger.Printf("Error configuring senders: %v", err)
+		os.Exit(1)
+	} else {
+		dispatcher.SetRecorder(&statusRecorder{db: db})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	options := pipelineOptions{
+		BatchSize:       *batchSize,
+		EnrichWorkers:   *enrichWorkers,
+		ScheduleWorkers: *scheduleWorkers,
+		Backfill:        *backfill,
+		DryRun:          *dryRun,
+	}
+	queue := newJobQueue(db, 100, *sendWorkers, logger)
+	if serveMode {
+		if err := serve(ctx, db, selected, rules.Schedules, queue, dispatcher, invalidTokens, options, *pollInterval, *listenInserts, logger); err != nil {
+			logger.Printf("Error serving: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var errs []error
+	report := newRunReport()
+	configs, err := loadNotificationConfigs(db)
+	if err != nil {
+		logger.Printf("Error loading notification config: %v", err)
+		os.Exit(1)
+	}
+
+	// Real runs queue notifications as they are built so delays survive restarts; dry runs print them
+	sink := func(notifications []Notification) error {
+		_, err := queue.Enqueue(notifications)
+		return err
+	}
+	if *dryRun {
+		sink = func(notifications []Notification) error {
+			for _, notification := range notifications {
+				dispatcher.deliver(ctx, notification)
+			}
+			return nil
+		}
+	}
+	for _, source := range selected {
+		logger.Printf("Running journey %s", source.Name())
+		errs = append(errs, runSource(ctx, db, source, options, configs, report, sink, logger)...)
+	}
+
+	// Deliver queued notifications as they fall due
+	var results []DeliveryResult
+	if !*dryRun {
+		var queueErrs []error
+		results, queueErrs = queue.Release(ctx, dispatcher, time.Now().Add(*maxWait))
+		errs = append(errs, queueErrs...)
+	}
+	for _, result := range results {
+		if result.Status == deliveryFailed {
+			errs = append(errs, result.Err)
+		}
+		if result.RecordErr != nil {
+			errs = append(errs, result.RecordErr)
+		}
+	}
+	dispatcher.waitForMirrors()
+	invalidTokens.log(logger)
+	report.log(logger)
+
+	// Report aggregated errors
+	if len(errs) > 0 {
+		logger.Printf("Encountered %d errors during processing:", len(errs))
+		for i, err := range errs {
+			logger.Printf("Error %d: %v", i+1, err)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,2 @@
+-- SMS configs reference the TRAI DLT template registered for their text
+ALTER TABLE notification_config ADD COLUMN IF NOT EXISTS dlt_template_id TEXT NOT NULL DEFAULT '';
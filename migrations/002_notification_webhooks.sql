@@ -0,0 +1,14 @@
+-- Webhook endpoints receiving the notification JSON, matched like notification_config by event and channel.
+-- An empty or '*' event_name/channel matches every value; a webhook channel config delivers only to webhooks.
+CREATE TABLE IF NOT EXISTS notification_webhooks (
+    id              SERIAL PRIMARY KEY,
+    event_name      TEXT NOT NULL DEFAULT '*',
+    channel         TEXT NOT NULL DEFAULT '*',
+    url             TEXT NOT NULL,
+    secret          TEXT NOT NULL DEFAULT '',
+    timeout_ms      INTEGER NOT NULL DEFAULT 5000,
+    max_retries     INTEGER NOT NULL DEFAULT 3,
+    max_concurrency INTEGER NOT NULL DEFAULT 4,
+    enabled         BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
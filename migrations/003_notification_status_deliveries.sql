@@ -0,0 +1,15 @@
+-- Every delivery writes a notification_status row; the latest sent row per user and event sets the next attempt.
+-- Rows written before this migration are treated as sent.
+CREATE TABLE IF NOT EXISTS notification_status (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    BIGINT NOT NULL,
+    event_name TEXT NOT NULL,
+    attempt    INTEGER NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT '';
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS message_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'sent';
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS sent_at TIMESTAMPTZ;
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS error TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS notification_status_user_event_idx ON notification_status (user_id, event_name, updated_at DESC);
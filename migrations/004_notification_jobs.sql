@@ -0,0 +1,16 @@
+-- Durable delayed-delivery queue. Workers claim due pending jobs with FOR UPDATE SKIP LOCKED;
+-- a job stuck in processing past its lease (worker crash) is claimed again.
+CREATE TABLE IF NOT EXISTS notification_jobs (
+    id           BIGSERIAL PRIMARY KEY,
+    job_key      TEXT NOT NULL, -- user_id:event_name:attempt
+    scheduled_at TIMESTAMPTZ NOT NULL,
+    payload      JSONB NOT NULL, -- Notification JSON
+    state        TEXT NOT NULL DEFAULT 'pending', -- pending, processing, sent, failed
+    locked_at    TIMESTAMPTZ,
+    last_error   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+-- A notification is queued at most once while it is waiting or being sent
+CREATE UNIQUE INDEX IF NOT EXISTS notification_jobs_open_key_idx ON notification_jobs (job_key) WHERE state IN ('pending', 'processing');
+CREATE INDEX IF NOT EXISTS notification_jobs_due_idx ON notification_jobs (scheduled_at) WHERE state IN ('pending', 'processing');
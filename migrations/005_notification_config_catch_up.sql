@@ -0,0 +1,4 @@
+-- What to do with notifications whose scheduled time passed before the run picked them up:
+-- drop, grace (send now if at most catch_up_grace_seconds late) or reanchor (next daily occurrence)
+ALTER TABLE notification_config ADD COLUMN IF NOT EXISTS catch_up_policy TEXT NOT NULL DEFAULT 'drop';
+ALTER TABLE notification_config ADD COLUMN IF NOT EXISTS catch_up_grace_seconds INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- High-water mark per journey: each scan reads rows anchored since the watermark (minus a small overlap)
+-- and advances it to the end of its window once every batch was processed.
+CREATE TABLE IF NOT EXISTS comms_checkpoints (
+    source     TEXT PRIMARY KEY, -- journey name, e.g. pan or arn-generated
+    watermark  TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
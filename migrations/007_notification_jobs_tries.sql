@@ -0,0 +1,2 @@
+-- Failed deliveries are retried with a backoff before a job is marked failed
+ALTER TABLE notification_jobs ADD COLUMN IF NOT EXISTS tries INTEGER NOT NULL DEFAULT 0;
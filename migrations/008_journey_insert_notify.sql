@@ -0,0 +1,24 @@
+-- Real-time triggering for `comms -listen serve`: every insert into a journey table publishes
+-- {"table": ..., "mobile_number": ...} on the comms_events channel. The trigger argument names the
+-- column holding the mobile number.
+CREATE OR REPLACE FUNCTION comms_notify_insert() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('comms_events', json_build_object(
+        'table', TG_TABLE_NAME,
+        'mobile_number', to_jsonb(NEW) ->> TG_ARGV[0]
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS comms_notify_insert ON flow_statuses;
+CREATE TRIGGER comms_notify_insert AFTER INSERT ON flow_statuses
+    FOR EACH ROW EXECUTE FUNCTION comms_notify_insert('mobile_number');
+
+DROP TRIGGER IF EXISTS comms_notify_insert ON card_statuses;
+CREATE TRIGGER comms_notify_insert AFTER INSERT ON card_statuses
+    FOR EACH ROW EXECUTE FUNCTION comms_notify_insert('mobile_number');
+
+DROP TRIGGER IF EXISTS comms_notify_insert ON arns;
+CREATE TRIGGER comms_notify_insert AFTER INSERT ON arns
+    FOR EACH ROW EXECUTE FUNCTION comms_notify_insert('phone_number');
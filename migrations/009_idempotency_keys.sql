@@ -0,0 +1,7 @@
+-- Deterministic idempotency key per notification (user_id, event_name, attempt, anchor timestamp).
+-- A notification is queued at most once unless its job failed, and sent at most once.
+ALTER TABLE notification_jobs ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS notification_jobs_idempotency_key_idx ON notification_jobs (idempotency_key) WHERE state <> 'failed';
+
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS notification_status_sent_key_idx ON notification_status (idempotency_key) WHERE status = 'sent';
@@ -0,0 +1,3 @@
+-- Notifications cancelled before sending because the user moved on in the journey are recorded with
+-- status 'superseded' and the status that made them stale.
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS superseded_by TEXT NOT NULL DEFAULT '';
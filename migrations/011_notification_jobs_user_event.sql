@@ -0,0 +1,6 @@
+-- Cross-journey arbitration looks up the other open jobs of a user before sending.
+ALTER TABLE notification_jobs ADD COLUMN IF NOT EXISTS user_id BIGINT;
+ALTER TABLE notification_jobs ADD COLUMN IF NOT EXISTS event_name TEXT;
+UPDATE notification_jobs SET user_id = (payload->>'user_id')::bigint, event_name = payload->>'event'
+WHERE user_id IS NULL AND state IN ('pending', 'processing');
+CREATE INDEX IF NOT EXISTS notification_jobs_open_user_idx ON notification_jobs (user_id) WHERE state IN ('pending', 'processing');
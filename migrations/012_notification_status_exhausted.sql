@@ -0,0 +1,5 @@
+-- A user who was sent the last attempt of an event (max_attempts or the end of notification_config) is recorded
+-- once with status 'exhausted'. anchor_at keeps the journey timestamp of the notification so `comms exhausted`
+-- can tell whether the user converted afterwards.
+ALTER TABLE notification_status ADD COLUMN IF NOT EXISTS anchor_at TIMESTAMPTZ;
+CREATE UNIQUE INDEX IF NOT EXISTS notification_status_exhausted_idx ON notification_status (user_id, event_name) WHERE status = 'exhausted';
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+)
+
+// UserDetails represents the user data we need from the users table
+type UserDetails struct {
+	ID                uint32
+	FullName          string
+	MobileNumber      string // For mapping with the journey's mobile_number
+	PlainMobileNumber string
+	Email             string
+}
+
+// CustomHeaderDetails represents the data from custom_headers
+type CustomHeaderDetails struct {
+	XPlatform    string
+	XDeviceToken string
+}
+
+// NotificationStatusDetails represents the data from notification_status
+type NotificationStatusDetails struct {
+	EventName  string
+	Attempt    int
+	LastSentAt time.Time
+}
+
+// NotificationConfigDetails represents the data from notification_config
+type NotificationConfigDetails struct {
+	Delay               int // Delay in seconds
+	Channel             string
+	EventName           string
+	EventID             int
+	DLTTemplateID       string // TRAI DLT template id for SMS configs
+	CatchUpPolicy       string // drop, grace or reanchor for past-due notifications
+	CatchUpGraceSeconds int    // How late a notification may be sent under the grace policy
+}
+
+// Notification represents the final struct handed to the dispatcher
+type Notification struct {
+	Event          string            `json:"event"`
+	Delay          float64           `json:"delay"` // Delay in seconds (fractional)
+	ScheduledAt    time.Time         `json:"scheduled_at"`
+	AnchorAt       time.Time         `json:"anchor_at"`       // Journey timestamp the attempt delays are added to
+	IdempotencyKey string            `json:"idempotency_key"` // See idempotencyKey; passed to providers that deduplicate requests
+	UserID         uint32            `json:"user_id"`
+	Mobile         string            `json:"mobile"`
+	PlainMobile    string            `json:"plain_mobile"`
+	Email          string            `json:"email,omitempty"`
+	CurrentStatus  string            `json:"current_status"`
+	Attempt        int               `json:"attempt"`
+	Source         string            `json:"source"`
+	Channel        string            `json:"channel"`
+	Metadata       map[string]string `json:"metadata"`
+	DeviceToken    string            `json:"device_token"`
+	Platform       string            `json:"platform"` // x_platform from custom_headers
+	EventID        int               `json:"event_id"`
+	DLTTemplateID  string            `json:"dlt_template_id,omitempty"`
+}
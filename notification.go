@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// idempotencyKey identifies a notification by user, event, attempt and journey anchor, so every scan, retry or
+// replay that finds the same notification derives the same key
+func idempotencyKey(userID uint32, eventName string, attempt int, anchorAt time.Time) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s:%d:%d", userID, eventName, attempt, anchorAt.UnixMicro())))
+	return hex.EncodeToString(sum[:16])
+}
+
+// buildNotification constructs a Notification struct with new_delay logic; past-due notifications follow the
+// config's catch-up policy and the decision is returned (empty when on time)
+func buildNotification(candidate Candidate, userDetail UserDetails, customHeader CustomHeaderDetails, notificationConfig NotificationConfigDetails, attempt int, defaultSource string) (Notification, string) {
+	eventName := candidate.EventType
+	source := os.Getenv("SOURCE")
+	if source == "" {
+		source = defaultSource
+	}
+
+	// Calculate scheduled_time = anchor_at + delay (in seconds)
+	scheduledTime := candidate.AnchorAt.Add(time.Duration(notificationConfig.Delay) * time.Second)
+
+	// Calculate new_delay = scheduled_time - current_time (in seconds, with fractional seconds)
+	currentTime := time.Now()
+	newDelay := scheduledTime.Sub(currentTime).Seconds()
+
+	// Log for debugging
+	log.Printf("user_id %d, event %s: anchor_at=%s, scheduledTime=%s, delay=%d seconds, newDelay=%.2f seconds",
+		userDetail.ID, eventName, candidate.AnchorAt.Format(time.RFC3339), scheduledTime.Format(time.RFC3339), notificationConfig.Delay, newDelay)
+
+	// Apply the catch-up policy to past-due notifications
+	decision := ""
+	if newDelay < 0 {
+		var keep bool
+		scheduledTime, decision, keep = catchUp(notificationConfig, scheduledTime, currentTime)
+		if !keep {
+			log.Printf("Skipping notification for user_id %d, event %s: negative delay (%.2f seconds), %s", userDetail.ID, eventName, newDelay, decision)
+			return Notification{}, decision
+		}
+		log.Printf("Catching up notification for user_id %d, event %s: %s, scheduledTime=%s", userDetail.ID, eventName, decision, scheduledTime.Format(time.RFC3339))
+	}
+
+	return newNotification(candidate, userDetail, customHeader, notificationConfig, attempt, source, scheduledTime), decision
+}
+
+// newNotification builds the notification due at scheduledTime, shifted into the channel's (or event's) send window
+func newNotification(candidate Candidate, userDetail UserDetails, customHeader CustomHeaderDetails, notificationConfig NotificationConfigDetails, attempt int, source string, scheduledTime time.Time) Notification {
+	eventName := candidate.EventType
+	if allowed := sendWindows.windowFor(notificationConfig.Channel, eventName).next(scheduledTime); !allowed.Equal(scheduledTime) {
+		log.Printf("Shifting notification for user_id %d, event %s, channel %s out of quiet hours: %s -> %s",
+			userDetail.ID, eventName, notificationConfig.Channel, scheduledTime.Format(time.RFC3339), allowed.Format(time.RFC3339))
+		scheduledTime = allowed
+	}
+
+	// Event specific metadata (e.g. Arn, Reasons) is carried over as-is
+	metadata := map[string]string{"Name": userDetail.FullName}
+	for key, value := range candidate.Metadata {
+		metadata[key] = value
+	}
+
+	return Notification{
+		Event:          notificationConfig.EventName,
+		Delay:          time.Until(scheduledTime).Seconds(),
+		ScheduledAt:    scheduledTime,
+		AnchorAt:       candidate.AnchorAt,
+		IdempotencyKey: idempotencyKey(userDetail.ID, notificationConfig.EventName, attempt, candidate.AnchorAt),
+		UserID:         userDetail.ID,
+		Mobile:         candidate.MobileNumber,
+		PlainMobile:    userDetail.PlainMobileNumber,
+		Email:          userDetail.Email,
+		CurrentStatus:  candidate.Status,
+		Attempt:        attempt,
+		Source:         source,
+		Channel:        notificationConfig.Channel,
+		Metadata:       metadata,
+		DeviceToken:    customHeader.XDeviceToken,
+		Platform:       customHeader.XPlatform,
+		EventID:        notificationConfig.EventID,
+		DLTTemplateID:  notificationConfig.DLTTemplateID,
+	}
+}
+
+// withContact replaces the contact details the notification was built with by the user's current ones; details
+// missing from contacts are kept
+func (n Notification) withContact(contacts contactDetails) Notification {
+	if user, ok := contacts.users[n.UserID]; ok {
+		n.PlainMobile = user.PlainMobileNumber
+		n.Email = user.Email
+		metadata := make(map[string]string, len(n.Metadata)+1)
+		for key, value := range n.Metadata {
+			metadata[key] = value
+		}
+		metadata["Name"] = user.FullName
+		n.Metadata = metadata
+	}
+	if header, ok := contacts.headers[n.UserID]; ok {
+		n.DeviceToken = header.XDeviceToken
+		n.Platform = header.XPlatform
+	}
+	return n
+}
+
+// nextAttempt builds the follow-up of a sent notification from the config of its next attempt, so attempt ladders
+// advance without rescanning the journey rows that started them; its contact details are refreshed when it is
+// released. It is due at anchor + delay, or right away when
+// that has passed: the catch-up policy is for scans finding old rows, while a follow-up is only late because the
+// previous attempt went out late (quiet hours, a frequency cap deferral, a retry)
+func nextAttempt(sent Notification, notificationConfig NotificationConfigDetails) Notification {
+	candidate := Candidate{
+		MobileNumber: sent.Mobile,
+		UserID:       sent.UserID,
+		EventType:    sent.Event,
+		AnchorAt:     sent.AnchorAt,
+		Status:       sent.CurrentStatus,
+		Metadata:     sent.Metadata,
+	}
+	userDetail := UserDetails{
+		ID:                sent.UserID,
+		FullName:          sent.Metadata["Name"],
+		MobileNumber:      sent.Mobile,
+		PlainMobileNumber: sent.PlainMobile,
+		Email:             sent.Email,
+	}
+	customHeader := CustomHeaderDetails{XPlatform: sent.Platform, XDeviceToken: sent.DeviceToken}
+	scheduledTime := sent.AnchorAt.Add(time.Duration(notificationConfig.Delay) * time.Second)
+	if now := time.Now(); scheduledTime.Before(now) {
+		log.Printf("Attempt %d for user_id %d, event %s was due at %s, scheduling it now",
+			sent.Attempt+1, sent.UserID, sent.Event, scheduledTime.Format(time.RFC3339))
+		scheduledTime = now
+	}
+	return newNotification(candidate, userDetail, customHeader, notificationConfig, sent.Attempt+1, sent.Source, scheduledTime)
+}
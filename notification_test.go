@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextAttemptIsNeverDropped(t *testing.T) {
+	sendWindows = SendWindows{}
+	defer func() { sendWindows = SendWindows{} }()
+
+	now := time.Now()
+	config := NotificationConfigDetails{EventName: "PAN_FORM_DROPOFF", Channel: "push", Delay: 6 * 3600, CatchUpPolicy: catchUpDrop}
+	tests := []struct {
+		name     string
+		anchorAt time.Time
+		want     time.Time
+	}{
+		{"due later", now.Add(-time.Hour), now.Add(5 * time.Hour)},
+		{"already past due", now.Add(-11 * time.Hour), now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := Notification{Event: "PAN_FORM_DROPOFF", UserID: 42, Attempt: 1, AnchorAt: tt.anchorAt, Channel: "push", Source: "test"}
+			next := nextAttempt(sent, config)
+			if next.Event != "PAN_FORM_DROPOFF" || next.Attempt != 2 {
+				t.Fatalf("next attempt = %s attempt %d, want PAN_FORM_DROPOFF attempt 2", next.Event, next.Attempt)
+			}
+			if next.ScheduledAt.Sub(tt.want).Abs() > time.Minute {
+				t.Errorf("scheduled at %s, want about %s", next.ScheduledAt, tt.want)
+			}
+			if !next.AnchorAt.Equal(tt.anchorAt) || next.IdempotencyKey != idempotencyKey(42, "PAN_FORM_DROPOFF", 2, tt.anchorAt) {
+				t.Errorf("next attempt lost its anchor or key")
+			}
+		})
+	}
+}
+
+func TestWithContactRefreshesQueuedDetails(t *testing.T) {
+	queued := Notification{
+		UserID:      7,
+		Email:       "old@example.com",
+		PlainMobile: "9800000001",
+		DeviceToken: "old-token",
+		Platform:    "android",
+		Metadata:    map[string]string{"Name": "A", "Arn": "ARN1"},
+	}
+	contacts := contactDetails{
+		users:   map[uint32]UserDetails{7: {ID: 7, FullName: "Asha", PlainMobileNumber: "9800000007", Email: "new@example.com"}},
+		headers: map[uint32]CustomHeaderDetails{7: {XPlatform: "ios", XDeviceToken: "new-token"}},
+	}
+	refreshed := queued.withContact(contacts)
+	if refreshed.Email != "new@example.com" || refreshed.PlainMobile != "9800000007" || refreshed.DeviceToken != "new-token" ||
+		refreshed.Platform != "ios" || refreshed.Metadata["Name"] != "Asha" || refreshed.Metadata["Arn"] != "ARN1" {
+		t.Errorf("refreshed notification = %+v", refreshed)
+	}
+	if queued.Metadata["Name"] != "A" {
+		t.Errorf("withContact modified the queued notification's metadata")
+	}
+
+	// A user without current rows keeps the queued details
+	if kept := queued.withContact(contactDetails{}); kept.DeviceToken != "old-token" || kept.Email != "old@example.com" {
+		t.Errorf("notification without current details = %+v, want the queued ones", kept)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// pipelineOptions bounds the concurrency, and with it the memory, of a journey scan and picks the rows it reads
+type pipelineOptions struct {
+	BatchSize       int           // Rows per source query; each batch flows through the pipeline on its own
+	EnrichWorkers   int           // Batches enriched and turned into notifications concurrently
+	ScheduleWorkers int           // Notification batches handed to the sink concurrently
+	Backfill        time.Duration // When set, rescan this far back instead of resuming from the checkpoint
+	DryRun          bool          // Read checkpoints without advancing them
+	Mobiles         []string      // When set, only these users are classified over the full window; checkpoints are left alone
+}
+
+// notificationSink receives the notifications built from one batch, e.g. to queue or print them
+type notificationSink func(notifications []Notification) error
+
+// runSource streams a journey through source -> enrich/decide -> schedule stages connected by bounded
+// channels, so a slow stage holds back the ones before it and at most a few batches are in memory. Only rows
+// since the journey's checkpoint are read, and the checkpoint advances once the whole window was processed
+func runSource(ctx context.Context, db *gorm.DB, source EventSource, options pipelineOptions, configs notificationConfigs,
+	report *runReport, sink notificationSink, logger *log.Logger) []error {
+	window, err := checkpointWindow(db, source, options, time.Now())
+	if err != nil {
+		return []error{err}
+	}
+	if options.EnrichWorkers <= 0 {
+		options.EnrichWorkers = 1
+	}
+	if options.ScheduleWorkers <= 0 {
+		options.ScheduleWorkers = 1
+	}
+
+	var mu sync.Mutex
+	var errs []error
+	addErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+	var candidateCount, notificationCount int64
+
+	// Source stage: emit blocks while every enrich worker is busy and the buffer is full
+	candidates := make(chan []Candidate, options.EnrichWorkers)
+	var fetchErr error
+	go func() {
+		defer close(candidates)
+		fetchErr = source.Fetch(db, window, options.BatchSize, func(batch []Candidate) error {
+			select {
+			case candidates <- batch:
+				atomic.AddInt64(&candidateCount, int64(len(batch)))
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	// Enrich and decide stage
+	built := make(chan []Notification, options.ScheduleWorkers)
+	var enrichers sync.WaitGroup
+	for i := 0; i < options.EnrichWorkers; i++ {
+		enrichers.Add(1)
+		go func() {
+			defer enrichers.Done()
+			for batch := range candidates {
+				notifications, err := buildBatch(db, source, batch, configs, report, logger)
+				if err != nil {
+					addErr(err)
+					continue
+				}
+				if len(notifications) > 0 {
+					built <- notifications
+				}
+			}
+		}()
+	}
+	go func() {
+		enrichers.Wait()
+		close(built)
+	}()
+
+	// Schedule stage
+	var schedulers sync.WaitGroup
+	for i := 0; i < options.ScheduleWorkers; i++ {
+		schedulers.Add(1)
+		go func() {
+			defer schedulers.Done()
+			for notifications := range built {
+				if err := sink(notifications); err != nil {
+					addErr(err)
+					continue
+				}
+				atomic.AddInt64(&notificationCount, int64(len(notifications)))
+			}
+		}()
+	}
+	schedulers.Wait()
+
+	if fetchErr != nil {
+		errs = append([]error{fmt.Errorf("error fetching %s users: %v", source.Name(), fetchErr)}, errs...)
+	}
+	// A failed batch is rescanned next time instead of being skipped by the checkpoint
+	if len(errs) == 0 && !options.DryRun && window.allMobiles() {
+		if err := saveCheckpoint(db, source.Name(), window.Until); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	logger.Printf("Finished journey %s: candidates=%d, notifications=%d, errors=%d",
+		source.Name(), candidateCount, notificationCount, len(errs))
+	return errs
+}
+
+// buildBatch enriches one batch of candidates and builds their notifications
+func buildBatch(db *gorm.DB, source EventSource, batch []Candidate, configs notificationConfigs, report *runReport, logger *log.Logger) ([]Notification, error) {
+	// Collect mobile numbers for batch fetching
+	mobileNumbers := make([]string, 0, len(batch))
+	processedMobileNumbers := make(map[string]struct{})
+	for _, user := range batch {
+		if _, exists := processedMobileNumbers[user.MobileNumber]; !exists {
+			mobileNumbers = append(mobileNumbers, user.MobileNumber)
+			processedMobileNumbers[user.MobileNumber] = struct{}{}
+		}
+	}
+	if len(mobileNumbers) == 0 {
+		return nil, nil
+	}
+
+	// Batch fetch user details
+	userDetailsMap, err := fetchUserDetails(db, mobileNumbers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect user IDs for custom headers
+	userIDs := make([]uint32, 0, len(userDetailsMap))
+	for _, detail := range userDetailsMap {
+		if detail.ID != 0 {
+			userIDs = append(userIDs, detail.ID)
+		}
+	}
+
+	// Batch fetch custom headers
+	customHeadersMap, err := fetchCustomHeader(db, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Batch fetch the latest sent attempt per user and event
+	eventNames := make([]string, 0)
+	seenEvents := make(map[string]struct{})
+	for _, candidate := range batch {
+		if _, exists := seenEvents[candidate.EventType]; !exists {
+			eventNames = append(eventNames, candidate.EventType)
+			seenEvents[candidate.EventType] = struct{}{}
+		}
+	}
+	statusMap, err := fetchNotificationStatuses(db, userIDs, eventNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process users and build notifications
+	var notifications []Notification
+	for _, candidate := range batch {
+		eventName := candidate.EventType
+
+		// Get user details from map
+		userDetail, exists := userDetailsMap[candidate.MobileNumber]
+		if !exists || userDetail.ID == 0 {
+			logger.Printf("No user found for mobile number %s", candidate.MobileNumber)
+			continue
+		}
+		if candidate.UserID != 0 && candidate.UserID != userDetail.ID {
+			logger.Printf("Candidate user_id %d does not match user_id %d for mobile number %s, using users table", candidate.UserID, userDetail.ID, candidate.MobileNumber)
+		}
+
+		// Get custom header from map
+		customHeader, exists := customHeadersMap[userDetail.ID]
+		if !exists {
+			customHeader = CustomHeaderDetails{XPlatform: "Unknown", XDeviceToken: ""}
+		}
+
+		attempt := 1
+		var lastSentAt time.Time
+		if notificationStatus, exists := statusMap[statusKey{UserID: userDetail.ID, EventName: eventName}]; exists {
+			attempt = notificationStatus.Attempt + 1
+			lastSentAt = notificationStatus.LastSentAt
+		}
+		limit := attemptLimits.forEvent(eventName)
+		if limit.exhausted(attempt - 1) {
+			logger.Printf("User_id %d has been sent all %d attempts of event %s, skipping", userDetail.ID, limit.MaxAttempts, eventName)
+			continue
+		}
+
+		notificationConfig, exists := configs.lookup(eventName, attempt)
+		if !exists {
+			logger.Printf("No notification config for user_id %d, event %s, attempt %d: end of the attempt ladder, skipping", userDetail.ID, eventName, attempt)
+			continue
+		}
+
+		// Build and collect notification
+		notification, decision := buildNotification(candidate, userDetail, customHeader, notificationConfig, attempt, source.DefaultSource())
+		if decision != "" {
+			report.addCatchUp(eventName, decision)
+		}
+		if notification.Event == "" {
+			continue
+		}
+		notifications = append(notifications, limit.spaced(notification, lastSentAt))
+	}
+	return notifications, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// printSender is the dry-run sender that writes notifications in a human-readable format
+type printSender struct {
+	out io.Writer
+}
+
+// Name identifies the sender
+func (printSender) Name() string { return "print" }
+
+// Send outputs the notification in a formatted way
+func (s printSender) Send(ctx context.Context, notification Notification) (string, error) {
+	fmt.Fprintf(s.out, "Notification:\n")
+	fmt.Fprintf(s.out, "  Event: %s\n", notification.Event)
+	fmt.Fprintf(s.out, "  Delay (seconds): %.2f\n", notification.Delay)
+	fmt.Fprintf(s.out, "  UserID: %d\n", notification.UserID)
+	fmt.Fprintf(s.out, "  Mobile: %s\n", notification.Mobile)
+	fmt.Fprintf(s.out, "  PlainMobile: %s\n", notification.PlainMobile)
+	fmt.Fprintf(s.out, "  CurrentStatus: %s\n", notification.CurrentStatus)
+	fmt.Fprintf(s.out, "  Attempt: %d\n", notification.Attempt)
+	fmt.Fprintf(s.out, "  Source: %s\n", notification.Source)
+	fmt.Fprintf(s.out, "  Channel: %s\n", notification.Channel)
+	fmt.Fprintf(s.out, "  Metadata: %s\n", formatMetadata(notification.Metadata))
+	fmt.Fprintf(s.out, "  DeviceToken: %s\n", notification.DeviceToken)
+	fmt.Fprintf(s.out, "  EventID: %d\n", notification.EventID)
+	fmt.Fprintf(s.out, "\n")
+	return "", nil
+}
+
+// formatMetadata renders metadata as {Key: value, ...} with keys in a stable order
+func formatMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		if key != "Name" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	parts := []string{fmt.Sprintf("Name: %s", metadata["Name"])}
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %s", key, metadata[key]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
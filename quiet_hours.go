@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// istLocation is the timezone send windows are evaluated in
+var istLocation = loadIST()
+
+// loadIST loads Asia/Kolkata, falling back to its fixed +05:30 offset when no tz database is available
+func loadIST() *time.Location {
+	location, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		log.Printf("Error loading Asia/Kolkata timezone, using fixed +05:30: %v", err)
+		return time.FixedZone("IST", 5*60*60+30*60)
+	}
+	return location
+}
+
+// sendWindows holds the windows of the loaded rules file; buildNotification shifts scheduled times into them
+var sendWindows SendWindows
+
+// SendWindow is the time of day, in Asia/Kolkata, during which notifications may be sent
+type SendWindow struct {
+	Start  string `yaml:"start" json:"start"`   // HH:MM, inclusive
+	End    string `yaml:"end" json:"end"`       // HH:MM, exclusive; before Start for windows spanning midnight
+	Always bool   `yaml:"always" json:"always"` // Send at any time, e.g. transactional events opting out of channel windows
+
+	start, end int // Minutes after midnight
+}
+
+// SendWindows are the per-channel windows and per-event overrides of a rules file
+type SendWindows struct {
+	Channels map[string]*SendWindow `yaml:"channels" json:"channels"`
+	Events   map[string]*SendWindow `yaml:"events" json:"events"`
+}
+
+// parseClock converts HH:MM to minutes after midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// resolve parses every window and normalizes channel names
+func (w *SendWindows) resolve() error {
+	channels := make(map[string]*SendWindow, len(w.Channels))
+	for channel, window := range w.Channels {
+		if err := window.resolve(); err != nil {
+			return fmt.Errorf("send window for channel %s: %v", channel, err)
+		}
+		channels[normalizeChannel(channel)] = window
+	}
+	w.Channels = channels
+	for event, window := range w.Events {
+		if err := window.resolve(); err != nil {
+			return fmt.Errorf("send window for event %s: %v", event, err)
+		}
+	}
+	return nil
+}
+
+// resolve parses the window's start and end
+func (w *SendWindow) resolve() error {
+	if w.Always {
+		return nil
+	}
+	var err error
+	if w.start, err = parseClock(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+// windowFor returns the event's window, else the channel's, or nil when sends are unrestricted
+func (w SendWindows) windowFor(channel, event string) *SendWindow {
+	if window, ok := w.Events[event]; ok {
+		return window
+	}
+	return w.Channels[normalizeChannel(channel)]
+}
+
+// next returns t when it falls inside the window, otherwise the start of the following window
+func (w *SendWindow) next(t time.Time) time.Time {
+	if w == nil || w.Always || w.start == w.end {
+		return t
+	}
+	local := t.In(istLocation)
+	minute := local.Hour()*60 + local.Minute()
+	var inside bool
+	if w.start < w.end {
+		inside = minute >= w.start && minute < w.end
+	} else {
+		inside = minute >= w.start || minute < w.end
+	}
+	if inside {
+		return t
+	}
+
+	opens := time.Date(local.Year(), local.Month(), local.Day(), w.start/60, w.start%60, 0, 0, istLocation)
+	if !opens.After(local) {
+		opens = opens.AddDate(0, 0, 1)
+	}
+	return opens
+}
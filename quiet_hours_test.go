@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// ist returns the given day and time of day in Asia/Kolkata
+func ist(day, hour, minute int) time.Time {
+	return time.Date(2026, 3, day, hour, minute, 0, 0, istLocation)
+}
+
+func TestSendWindowNext(t *testing.T) {
+	day := &SendWindow{Start: "09:00", End: "21:00"}
+	overnight := &SendWindow{Start: "22:00", End: "06:00"}
+	for _, window := range []*SendWindow{day, overnight} {
+		if err := window.resolve(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		window *SendWindow
+		t      time.Time
+		want   time.Time
+	}{
+		{"inside", day, ist(2, 12, 0), ist(2, 12, 0)},
+		{"at the start", day, ist(2, 9, 0), ist(2, 9, 0)},
+		{"before", day, ist(2, 7, 30), ist(2, 9, 0)},
+		{"after", day, ist(2, 22, 15), ist(3, 9, 0)},
+		{"at the end, which is exclusive", day, ist(2, 21, 0), ist(3, 9, 0)},
+		{"before, given in UTC", day, time.Date(2026, 3, 2, 2, 0, 0, 0, time.UTC), ist(2, 9, 0)},
+		{"overnight, late evening", overnight, ist(2, 23, 0), ist(2, 23, 0)},
+		{"overnight, early morning", overnight, ist(3, 3, 0), ist(3, 3, 0)},
+		{"overnight, during the day", overnight, ist(2, 12, 0), ist(2, 22, 0)},
+		{"overnight, at the end", overnight, ist(3, 6, 0), ist(3, 22, 0)},
+		{"always", &SendWindow{Always: true}, ist(2, 3, 0), ist(2, 3, 0)},
+		{"no window", nil, ist(2, 3, 0), ist(2, 3, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.next(tt.t); !got.Equal(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.t, got.In(istLocation), tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWindowsEventOverridesChannel(t *testing.T) {
+	windows := SendWindows{
+		Channels: map[string]*SendWindow{"SMS ": {Start: "09:00", End: "21:00"}},
+		Events: map[string]*SendWindow{
+			"ARN_GENERATED":    {Always: true},
+			"PAN_FORM_DROPOFF": {Start: "10:00", End: "18:00"},
+		},
+	}
+	if err := windows.resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	night := ist(2, 23, 0)
+	tests := []struct {
+		channel, event string
+		want           time.Time
+	}{
+		{"sms", "VKYC_DROPOFF", ist(3, 9, 0)},       // Channel window, matched after normalizing the name
+		{"sms", "ARN_GENERATED", night},             // Transactional event opts out
+		{"sms", "PAN_FORM_DROPOFF", ist(3, 10, 0)},  // Event window replaces the channel's
+		{"push", "PAN_FORM_DROPOFF", ist(3, 10, 0)}, // Event window applies on every channel
+		{"push", "VKYC_DROPOFF", night},             // No window for the channel
+	}
+	for _, tt := range tests {
+		if got := windows.windowFor(tt.channel, tt.event).next(night); !got.Equal(tt.want) {
+			t.Errorf("%s on %s at %s: next = %s, want %s", tt.event, tt.channel, night, got.In(istLocation), tt.want)
+		}
+	}
+}
+
+func TestSendWindowsRejectInvalidTimes(t *testing.T) {
+	for _, window := range []*SendWindow{{Start: "9am", End: "21:00"}, {Start: "09:00", End: "25:00"}, {Start: "09:00"}} {
+		windows := SendWindows{Channels: map[string]*SendWindow{"sms": window}}
+		if err := windows.resolve(); err == nil {
+			t.Errorf("resolve accepted window %s-%s", window.Start, window.End)
+		}
+	}
+}
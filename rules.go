@@ -0,0 +1,328 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// defaultRules is the journeys.yaml shipped with the binary, used when no rules file is given
+//
+//go:embed journeys.yaml
+var defaultRules []byte
+
+// identifierPattern restricts table and column names interpolated into rule queries
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// RulesFile is the top level of a journey rules file
+type RulesFile struct {
+	StatusLists   map[string][]string `yaml:"status_lists" json:"status_lists"`
+	Journeys      []JourneyRule       `yaml:"journeys" json:"journeys"`
+	Schedules     map[string]string   `yaml:"schedules" json:"schedules"` // Event, journey name or "default" -> cron expression for serve mode
+	SendWindows   SendWindows         `yaml:"send_windows" json:"send_windows"`
+	Arbitration   Arbitration         `yaml:"arbitration" json:"arbitration"`
+	FrequencyCaps FrequencyCaps       `yaml:"frequency_caps" json:"frequency_caps"`
+	Attempts      AttemptLimits       `yaml:"attempts" json:"attempts"`
+}
+
+// JourneyRule describes one journey whose events are detected from a status table
+type JourneyRule struct {
+	Name         string      `yaml:"name" json:"name"`
+	Source       string      `yaml:"source" json:"source"`
+	Table        string      `yaml:"table" json:"table"`                 // Defaults to flow_statuses
+	AnchorColumn string      `yaml:"anchor_column" json:"anchor_column"` // Defaults to created_at
+	LookbackDays int         `yaml:"lookback_days" json:"lookback_days"` // Defaults to LOOKBACK_DAYS
+	LatestOnly   bool        `yaml:"latest_only" json:"latest_only"`
+	Events       []EventRule `yaml:"events" json:"events"`
+}
+
+// EventRule classifies a status row as a journey event
+type EventRule struct {
+	Event           string   `yaml:"event" json:"event"`
+	TriggerStatuses []string `yaml:"trigger_statuses" json:"trigger_statuses"`
+	NotFollowedBy   []string `yaml:"not_followed_by" json:"not_followed_by"`
+	NeverReached    []string `yaml:"never_reached" json:"never_reached"`
+}
+
+// loadRules reads a rules file, or the embedded journeys.yaml when path is empty
+func loadRules(path string) (RulesFile, error) {
+	var rules RulesFile
+	data := defaultRules
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return RulesFile{}, fmt.Errorf("error reading rules file %s: %v", path, err)
+		}
+	}
+
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &rules)
+	} else {
+		err = yaml.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return RulesFile{}, fmt.Errorf("error parsing rules file %s: %v", path, err)
+	}
+
+	if err := rules.resolve(); err != nil {
+		return RulesFile{}, err
+	}
+	return rules, nil
+}
+
+// resolve applies defaults, expands @status_list references and validates every journey, send window, the
+// arbitration settings, frequency caps and attempt limits
+func (r *RulesFile) resolve() error {
+	if err := r.SendWindows.resolve(); err != nil {
+		return err
+	}
+	if err := r.Arbitration.resolve(); err != nil {
+		return err
+	}
+	if err := r.FrequencyCaps.resolve(); err != nil {
+		return err
+	}
+	if err := r.Attempts.resolve(); err != nil {
+		return err
+	}
+	for i := range r.Journeys {
+		j := &r.Journeys[i]
+		if j.Name == "" {
+			return fmt.Errorf("journey %d has no name", i+1)
+		}
+		if j.Table == "" {
+			j.Table = "flow_statuses"
+		}
+		if j.AnchorColumn == "" {
+			j.AnchorColumn = "created_at"
+		}
+		if !identifierPattern.MatchString(j.Table) || !identifierPattern.MatchString(j.AnchorColumn) {
+			return fmt.Errorf("journey %s: invalid table %q or anchor_column %q", j.Name, j.Table, j.AnchorColumn)
+		}
+		if j.Source == "" {
+			j.Source = "legacy " + j.Name + " default"
+		}
+		if len(j.Events) == 0 {
+			return fmt.Errorf("journey %s has no events", j.Name)
+		}
+
+		for k := range j.Events {
+			e := &j.Events[k]
+			if e.Event == "" {
+				return fmt.Errorf("journey %s: event %d has no name", j.Name, k+1)
+			}
+			var err error
+			if e.TriggerStatuses, err = r.expand(e.TriggerStatuses, nil); err != nil {
+				return fmt.Errorf("journey %s, event %s: %v", j.Name, e.Event, err)
+			}
+			if e.NotFollowedBy, err = r.expand(e.NotFollowedBy, nil); err != nil {
+				return fmt.Errorf("journey %s, event %s: %v", j.Name, e.Event, err)
+			}
+			if e.NeverReached, err = r.expand(e.NeverReached, nil); err != nil {
+				return fmt.Errorf("journey %s, event %s: %v", j.Name, e.Event, err)
+			}
+			if len(e.TriggerStatuses) == 0 {
+				return fmt.Errorf("journey %s, event %s has no trigger_statuses", j.Name, e.Event)
+			}
+		}
+	}
+	return nil
+}
+
+// expand replaces @name entries with the statuses of the named status list
+func (r *RulesFile) expand(statuses []string, seen []string) ([]string, error) {
+	var expanded []string
+	for _, status := range statuses {
+		name, isRef := strings.CutPrefix(status, "@")
+		if !isRef {
+			expanded = append(expanded, status)
+			continue
+		}
+		for _, s := range seen {
+			if s == name {
+				return nil, fmt.Errorf("status list %s references itself", name)
+			}
+		}
+		list, ok := r.StatusLists[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown status list %s", name)
+		}
+		nested, err := r.expand(list, append(seen, name))
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, nested...)
+	}
+	return expanded, nil
+}
+
+// compile builds the classification query for a journey over the scan window. The query pages by keyset
+// (anchor_at, mobile_number, status) and ends in "AND (? OR (anchor, mobile_number, status) > (?, ?, ?)) ...
+// ORDER BY ... LIMIT ?", taking whether this is the first page, the last row's key and the page size. The keyset
+// predicate filters the status rows directly, so every page starts from the index instead of re-reading the window.
+func (j JourneyRule) compile(window scanWindow) (string, []interface{}) {
+	var args []interface{}
+	var cases strings.Builder
+	for _, e := range j.Events {
+		cases.WriteString("\n\t\t\t\t\t\tWHEN fs.status IN ?")
+		args = append(args, e.TriggerStatuses)
+		if len(e.NotFollowedBy) > 0 {
+			fmt.Fprintf(&cases, ` AND NOT EXISTS (
+							SELECT 1 FROM %[1]s fs2
+							WHERE fs2.mobile_number = fs.mobile_number
+							AND fs2.status IN ? AND fs2.%[2]s >= fs.%[2]s
+						)`, j.Table, j.AnchorColumn)
+			args = append(args, e.NotFollowedBy)
+		}
+		if len(e.NeverReached) > 0 {
+			fmt.Fprintf(&cases, ` AND NOT EXISTS (
+							SELECT 1 FROM %s fs2
+							WHERE fs2.mobile_number = fs.mobile_number
+							AND fs2.status IN ?
+						)`, j.Table)
+			args = append(args, e.NeverReached)
+		}
+		cases.WriteString(" THEN ?")
+		args = append(args, e.Event)
+	}
+	args = append(args, window.Since, window.Until)
+
+	// The user's latest row in the window: no later row for the same mobile number before the window ends
+	latestFilter := ""
+	if j.LatestOnly {
+		latestFilter = fmt.Sprintf(`
+				AND NOT EXISTS (
+					SELECT 1 FROM %[1]s fs3
+					WHERE fs3.mobile_number = fs.mobile_number
+					AND fs3.%[2]s > fs.%[2]s AND fs3.%[2]s < ?::timestamptz
+				)`, j.Table, j.AnchorColumn)
+		args = append(args, window.Until)
+	}
+	args = append(args, window.allMobiles(), window.Mobiles)
+
+	query := fmt.Sprintf(`
+			SELECT DISTINCT mobile_number, status, anchor_at, event_type
+			FROM (
+				SELECT fs.mobile_number, fs.status, fs.%[2]s AS anchor_at,
+					CASE%[3]s
+						ELSE NULL
+					END AS event_type
+				FROM %[1]s fs
+				WHERE fs.%[2]s >= ?::timestamptz AND fs.%[2]s < ?::timestamptz%[4]s
+				AND (?::boolean OR fs.mobile_number IN ?)
+				AND (?::boolean OR (fs.%[2]s, fs.mobile_number, fs.status) > (?, ?, ?))
+			) AS subquery
+			WHERE event_type IS NOT NULL
+			ORDER BY anchor_at, mobile_number, status
+			LIMIT ?
+		`, j.Table, j.AnchorColumn, cases.String(), latestFilter)
+	return query, args
+}
+
+// ruleSource is an EventSource backed by a declarative journey rule
+type ruleSource struct {
+	rule JourneyRule
+}
+
+// Name returns the subcommand name of the journey
+func (s ruleSource) Name() string { return s.rule.Name }
+
+// DefaultSource returns the notification source used when SOURCE is not set
+func (s ruleSource) DefaultSource() string { return s.rule.Source }
+
+// Table returns the status table the rule classifies
+func (s ruleSource) Table() string { return s.rule.Table }
+
+// Events returns the events the rule emits
+func (s ruleSource) Events() []string {
+	events := make([]string, 0, len(s.rule.Events))
+	for _, e := range s.rule.Events {
+		events = append(events, e.Event)
+	}
+	return events
+}
+
+// Window covers the rule's lookback, falling back to LOOKBACK_DAYS
+func (s ruleSource) Window(now time.Time) scanWindow {
+	lookbackDays := s.rule.LookbackDays
+	if lookbackDays <= 0 {
+		lookbackDays = lookbackDaysFromEnv()
+	}
+	return newScanWindow(now, lookbackDays)
+}
+
+// Fetch runs the compiled rule query in keyset batches
+func (s ruleSource) Fetch(db *gorm.DB, window scanWindow, batchSize int, emit func([]Candidate) error) error {
+	total := 0
+
+	log.Printf("Fetching %s users from %s between %s and %s", s.rule.Name, s.rule.Table, window.Since.Format(time.RFC3339), window.Until.Format(time.RFC3339))
+
+	query, args := s.rule.compile(window)
+	first := true
+	var lastAnchor time.Time
+	var lastMobile, lastStatus string
+	for {
+		var users []struct {
+			MobileNumber string
+			Status       string
+			AnchorAt     time.Time
+			EventType    string
+		}
+		err := db.Raw(query, append(args, first, lastAnchor, lastMobile, lastStatus, batchSize)...).Scan(&users).Error
+		if err != nil {
+			log.Printf("Error fetching %s users after %s: %v", s.rule.Name, lastAnchor.Format(time.RFC3339), err)
+			return fmt.Errorf("error fetching %s users after %s: %v", s.rule.Name, lastAnchor.Format(time.RFC3339), err)
+		}
+
+		batch := make([]Candidate, 0, len(users))
+		for _, user := range users {
+			batch = append(batch, Candidate{
+				MobileNumber: user.MobileNumber,
+				EventType:    user.EventType,
+				AnchorAt:     user.AnchorAt,
+				Status:       user.Status,
+			})
+		}
+
+		total += len(batch)
+		log.Printf("Fetched batch of %s users: batchSize=%d, totalFetched=%d", s.rule.Name, len(users), total)
+		if err := emit(batch); err != nil {
+			return err
+		}
+		if len(users) < batchSize {
+			break
+		}
+		last := users[len(users)-1]
+		first, lastAnchor, lastMobile, lastStatus = false, last.AnchorAt, last.MobileNumber, last.Status
+	}
+
+	if total == 0 {
+		log.Printf("No users found in %s between %s and %s. Please verify data or adjust LOOKBACK_DAYS.", s.rule.Table, window.Since.Format(time.RFC3339), window.Until.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// registerRules registers an event source for every journey in the rules file and applies its send windows,
+// pre-send re-validation, arbitration, frequency caps and attempt limits
+func registerRules(rules RulesFile) {
+	for _, rule := range rules.Journeys {
+		registerSource(ruleSource{rule: rule})
+	}
+	sendWindows = rules.SendWindows
+	supersedeRules = newSupersedeRules(rules.Journeys)
+	arbitration = rules.Arbitration
+	frequencyCaps = rules.FrequencyCaps
+	attemptLimits = rules.Attempts
+}
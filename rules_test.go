@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestExpandStatusLists(t *testing.T) {
+	rules := RulesFile{StatusLists: map[string][]string{
+		"kyc":      {"PAN_FORM", "AADHAR_FORM"},
+		"approved": {"@kyc", "VKYC_DONE"},
+		"all":      {"@approved", "CARD_ISSUED"},
+		"loop":     {"A", "@cycle"},
+		"cycle":    {"@loop"},
+		"self":     {"@self"},
+		"missing":  {"@nowhere"},
+	}}
+	tests := []struct {
+		statuses []string
+		want     []string
+		wantErr  string
+	}{
+		{[]string{"PAN_FORM_START"}, []string{"PAN_FORM_START"}, ""},
+		{[]string{"@kyc", "X"}, []string{"PAN_FORM", "AADHAR_FORM", "X"}, ""},
+		{[]string{"@all"}, []string{"PAN_FORM", "AADHAR_FORM", "VKYC_DONE", "CARD_ISSUED"}, ""},
+		{[]string{"@self"}, nil, "status list self references itself"},
+		{[]string{"@loop"}, nil, "status list loop references itself"},
+		{[]string{"@unknown"}, nil, "unknown status list unknown"},
+		{[]string{"@missing"}, nil, "unknown status list nowhere"},
+	}
+	for _, tt := range tests {
+		got, err := rules.expand(tt.statuses, nil)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expand(%v) error = %v, want %q", tt.statuses, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expand(%v) = %v, %v, want %v", tt.statuses, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolveValidatesJourneys(t *testing.T) {
+	event := []EventRule{{Event: "PAN_FORM_DROPOFF", TriggerStatuses: []string{"PAN_FORM_START"}}}
+	tests := []struct {
+		name    string
+		journey JourneyRule
+		wantErr string
+	}{
+		{"defaults", JourneyRule{Name: "pan", Events: event}, ""},
+		{"custom table", JourneyRule{Name: "pan", Table: "kyc_statuses", AnchorColumn: "updated_at", Events: event}, ""},
+		{"table injection", JourneyRule{Name: "pan", Table: "flow_statuses; DROP TABLE users", Events: event}, "invalid table"},
+		{"quoted table", JourneyRule{Name: "pan", Table: `"Flow"`, Events: event}, "invalid table"},
+		{"anchor injection", JourneyRule{Name: "pan", AnchorColumn: "created_at)--", Events: event}, "invalid table"},
+		{"no name", JourneyRule{Events: event}, "has no name"},
+		{"no events", JourneyRule{Name: "pan"}, "has no events"},
+		{"no trigger statuses", JourneyRule{Name: "pan", Events: []EventRule{{Event: "PAN_FORM_DROPOFF"}}}, "has no trigger_statuses"},
+		{"unknown list", JourneyRule{Name: "pan", Events: []EventRule{{Event: "PAN_FORM_DROPOFF", TriggerStatuses: []string{"@nope"}}}}, "unknown status list nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := RulesFile{Journeys: []JourneyRule{tt.journey}}
+			err := rules.resolve()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("resolve: %v", err)
+				}
+				if j := rules.Journeys[0]; j.Table == "" || j.AnchorColumn == "" || j.Source == "" {
+					t.Errorf("defaults not applied: %+v", j)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("resolve error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadRulesYAMLAndJSON(t *testing.T) {
+	yamlRules := `
+status_lists:
+  kyc: [PAN_FORM, AADHAR_FORM]
+journeys:
+  - name: vkyc
+    latest_only: true
+    events:
+      - event: VKYC_DROPOFF
+        trigger_statuses: [VKYC_START]
+        not_followed_by: ["@kyc", VKYC_DONE]
+`
+	jsonRules := `{
+		"status_lists": {"kyc": ["PAN_FORM", "AADHAR_FORM"]},
+		"journeys": [{
+			"name": "vkyc",
+			"latest_only": true,
+			"events": [{"event": "VKYC_DROPOFF", "trigger_statuses": ["VKYC_START"], "not_followed_by": ["@kyc", "VKYC_DONE"]}]
+		}]
+	}`
+	dir := t.TempDir()
+	for name, content := range map[string]string{"rules.yaml": yamlRules, "rules.JSON": jsonRules} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := loadRules(path)
+			if err != nil {
+				t.Fatalf("loadRules: %v", err)
+			}
+			if len(rules.Journeys) != 1 {
+				t.Fatalf("loaded %d journeys, want 1", len(rules.Journeys))
+			}
+			j := rules.Journeys[0]
+			if j.Name != "vkyc" || !j.LatestOnly || j.Table != "flow_statuses" || j.AnchorColumn != "created_at" || j.Source != "legacy vkyc default" {
+				t.Errorf("journey = %+v", j)
+			}
+			if want := []string{"PAN_FORM", "AADHAR_FORM", "VKYC_DONE"}; !reflect.DeepEqual(j.Events[0].NotFollowedBy, want) {
+				t.Errorf("not_followed_by = %v, want %v", j.Events[0].NotFollowedBy, want)
+			}
+		})
+	}
+
+	if _, err := loadRules(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("loadRules of a missing file succeeded")
+	}
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(yamlRules), 0o600)
+	if _, err := loadRules(bad); err == nil || !strings.Contains(err.Error(), "error parsing rules file") {
+		t.Errorf("loadRules of YAML named .json = %v, want a parse error", err)
+	}
+}
+
+func TestLoadEmbeddedRules(t *testing.T) {
+	rules, err := loadRules("")
+	if err != nil {
+		t.Fatalf("loadRules of the embedded journeys.yaml: %v", err)
+	}
+	if len(rules.Journeys) == 0 {
+		t.Fatal("embedded journeys.yaml has no journeys")
+	}
+	for _, j := range rules.Journeys {
+		for _, e := range j.Events {
+			for _, status := range append(append(e.TriggerStatuses, e.NotFollowedBy...), e.NeverReached...) {
+				if strings.HasPrefix(status, "@") {
+					t.Errorf("journey %s, event %s: unexpanded status %s", j.Name, e.Event, status)
+				}
+			}
+		}
+	}
+}
+
+// compiledSQL renders the compiled query of a journey for its first page with gorm's Postgres dialect
+func compiledSQL(t *testing.T, rule JourneyRule, window scanWindow) (string, []interface{}) {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args := rule.compile(window)
+	sql := db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		var rows []Candidate
+		return tx.Raw(query, append(args, true, time.Time{}, "", "", 50)...).Scan(&rows)
+	})
+	return strings.Join(strings.Fields(sql), " "), args
+}
+
+func TestCompileQueryShape(t *testing.T) {
+	since := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := since.AddDate(0, 0, 7)
+	window := scanWindow{Since: since, Until: until}
+	rules := RulesFile{Journeys: []JourneyRule{{
+		Name: "pan",
+		Events: []EventRule{
+			{Event: "PAN_FORM_DROPOFF", TriggerStatuses: []string{"PAN_FORM_START"}, NotFollowedBy: []string{"PAN_FORM"}},
+			{Event: "PAN_FAILURE", TriggerStatuses: []string{"PAN_FAILED"}, NeverReached: []string{"PAN_VERIFIED"}},
+		},
+	}}}
+	if err := rules.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	rule := rules.Journeys[0]
+
+	query, args := rule.compile(window)
+	// Every placeholder but the trailing first page flag, keyset and limit has an argument
+	if placeholders := strings.Count(query, "?"); placeholders != len(args)+5 {
+		t.Errorf("query has %d placeholders for %d args plus 5 paging args", placeholders, len(args))
+	}
+	wantArgs := []interface{}{
+		[]string{"PAN_FORM_START"}, []string{"PAN_FORM"}, "PAN_FORM_DROPOFF",
+		[]string{"PAN_FAILED"}, []string{"PAN_VERIFIED"}, "PAN_FAILURE",
+		since, until, true, []string(nil),
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+
+	sql, _ := compiledSQL(t, rule, window)
+	for _, want := range []string{
+		"WHEN fs.status IN ('PAN_FORM_START') AND NOT EXISTS ( SELECT 1 FROM flow_statuses fs2 WHERE fs2.mobile_number = fs.mobile_number AND fs2.status IN ('PAN_FORM') AND fs2.created_at >= fs.created_at ) THEN 'PAN_FORM_DROPOFF'",
+		"WHEN fs.status IN ('PAN_FAILED') AND NOT EXISTS ( SELECT 1 FROM flow_statuses fs2 WHERE fs2.mobile_number = fs.mobile_number AND fs2.status IN ('PAN_VERIFIED') ) THEN 'PAN_FAILURE'",
+		"FROM flow_statuses fs WHERE fs.created_at >= '2026-03-01 00:00:00'::timestamptz AND fs.created_at < '2026-03-08 00:00:00'::timestamptz",
+		"AND (true::boolean OR (fs.created_at, fs.mobile_number, fs.status) > (",
+		"WHERE event_type IS NOT NULL ORDER BY anchor_at, mobile_number, status LIMIT 50",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("compiled query does not contain %q:\n%s", want, sql)
+		}
+	}
+	if strings.Contains(sql, "OVER (") || strings.Contains(sql, "fs3") {
+		t.Errorf("compiled query without latest_only has a latest row check:\n%s", sql)
+	}
+
+	// latest_only adds a NOT EXISTS check on later rows before the window ends, not a window function
+	rule.LatestOnly = true
+	rule.AnchorColumn = "updated_at"
+	query, args = rule.compile(window)
+	if placeholders := strings.Count(query, "?"); placeholders != len(args)+5 {
+		t.Errorf("latest_only query has %d placeholders for %d args plus 5 paging args", placeholders, len(args))
+	}
+	sql, _ = compiledSQL(t, rule, window)
+	want := "AND NOT EXISTS ( SELECT 1 FROM flow_statuses fs3 WHERE fs3.mobile_number = fs.mobile_number AND fs3.updated_at > fs.updated_at AND fs3.updated_at < '2026-03-08 00:00:00'::timestamptz )"
+	if !strings.Contains(sql, want) || strings.Contains(sql, "OVER (") {
+		t.Errorf("latest_only query does not contain %q:\n%s", want, sql)
+	}
+
+	// Listener scans restrict the window to the inserted users
+	window.Mobiles = []string{"9800000001", "9800000002"}
+	sql, _ = compiledSQL(t, rule, window)
+	if !regexp.MustCompile(`\(false::boolean OR fs\.mobile_number IN \('9800000001','9800000002'\)\)`).MatchString(sql) {
+		t.Errorf("listener query does not restrict the mobile numbers:\n%s", sql)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// invalidTokenReport collects device tokens rejected by FCM so they can be cleaned up
+type invalidTokenReport struct {
+	mu     sync.Mutex
+	tokens []*InvalidTokenError
+}
+
+// add records an invalid token
+func (r *invalidTokenReport) add(invalid *InvalidTokenError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens = append(r.tokens, invalid)
+}
+
+// log writes and clears the collected invalid tokens
+func (r *invalidTokenReport) log(logger *log.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.tokens) == 0 {
+		return
+	}
+	defer func() { r.tokens = nil }()
+	logger.Printf("Invalid device tokens to clean up: total=%d", len(r.tokens))
+	for _, invalid := range r.tokens {
+		logger.Printf("Invalid device token: user_id=%d, reason=%s, token=%s", invalid.UserID, invalid.Reason, invalid.Token)
+	}
+}
+
+// configureSenders registers a sender for every channel whose provider is configured in the environment
+func configureSenders(db *gorm.DB, dispatcher *Dispatcher, invalidTokens *invalidTokenReport) error {
+	if serviceAccountFile := os.Getenv("FCM_SERVICE_ACCOUNT_FILE"); serviceAccountFile != "" {
+		sender, err := newFCMSender(serviceAccountFile, os.Getenv("FCM_ENDPOINT"), invalidTokens.add)
+		if err != nil {
+			return fmt.Errorf("error configuring FCM sender: %v", err)
+		}
+		dispatcher.Register("push", sender)
+	}
+
+	if gatewayURL := os.Getenv("SMS_GATEWAY_URL"); gatewayURL != "" {
+		templates, err := loadDLTTemplates(os.Getenv("SMS_TEMPLATES_FILE"))
+		if err != nil {
+			return fmt.Errorf("error configuring SMS sender: %v", err)
+		}
+		gateway, err := newHTTPSMSGateway(os.Getenv("SMS_GATEWAY_NAME"), gatewayURL,
+			os.Getenv("SMS_GATEWAY_AUTH_HEADER"), os.Getenv("SMS_GATEWAY_API_KEY"), os.Getenv("SMS_GATEWAY_FORMAT"),
+			os.Getenv("SMS_GATEWAY_PARAMS"), os.Getenv("SMS_GATEWAY_MESSAGE_ID_FIELD"), os.Getenv("SMS_GATEWAY_IDEMPOTENCY_HEADER"))
+		if err != nil {
+			return fmt.Errorf("error configuring SMS sender: %v", err)
+		}
+		dispatcher.Register("sms", &smsSender{provider: gateway, templates: templates})
+	}
+
+	if phoneNumberID := os.Getenv("WHATSAPP_PHONE_NUMBER_ID"); phoneNumberID != "" {
+		templates, err := loadWhatsAppTemplates(os.Getenv("WHATSAPP_TEMPLATES_FILE"))
+		if err != nil {
+			return fmt.Errorf("error configuring WhatsApp sender: %v", err)
+		}
+		sender, err := newWhatsAppSender(os.Getenv("WHATSAPP_ENDPOINT"), phoneNumberID,
+			os.Getenv("WHATSAPP_ACCESS_TOKEN"), os.Getenv("WHATSAPP_COUNTRY_CODE"), templates)
+		if err != nil {
+			return fmt.Errorf("error configuring WhatsApp sender: %v", err)
+		}
+		dispatcher.Register("whatsapp", sender)
+	}
+
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		templatesDir := os.Getenv("EMAIL_TEMPLATES_DIR")
+		templates, err := loadEmailTemplates(templatesDir)
+		if err != nil {
+			return fmt.Errorf("error configuring email sender: %v", err)
+		}
+		sender, err := newEmailSender(smtpHost, os.Getenv("SMTP_PORT"), os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"), os.Getenv("EMAIL_FROM"), templates)
+		if err != nil {
+			return fmt.Errorf("error configuring email sender: %v", err)
+		}
+		if hook, err := rejectionLetterHook(templatesDir, "CREDIT_CARD_REJECTED"); err == nil {
+			sender.RegisterAttachmentHook("CREDIT_CARD_REJECTED", hook)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("error configuring email sender: %v", err)
+		}
+		dispatcher.Register("email", sender)
+	}
+
+	if os.Getenv("WEBHOOKS_ENABLED") == "true" {
+		endpoints, err := fetchWebhookEndpoints(db)
+		if err != nil {
+			return fmt.Errorf("error configuring webhook sender: %v", err)
+		}
+		sender := newWebhookSender(endpoints)
+		dispatcher.Register("webhook", sender)
+		dispatcher.AddSink(sender)
+	}
+	return nil
+}
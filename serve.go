@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+)
+
+// defaultSchedule is used for journeys without an entry in the rules file schedules
+const defaultSchedule = "@every 15m"
+
+// sourceEvents returns the events a journey emits, or nil when the journey does not declare them
+func sourceEvents(source EventSource) []string {
+	switch s := source.(type) {
+	case interface{ Events() []string }:
+		return s.Events()
+	case interface{ Event() string }:
+		return []string{s.Event()}
+	}
+	return nil
+}
+
+// journeySchedules returns the cron specs a journey is scanned on: each of its events follows its own entry in
+// schedules, else the journey's, else "default", else defaultSchedule. A scan covers every event of the journey
+// (its checkpoint is shared), so a journey whose events have different schedules is scanned on all of them
+func journeySchedules(source EventSource, schedules map[string]string) []string {
+	fallback := schedules[source.Name()]
+	if fallback == "" {
+		fallback = schedules["default"]
+	}
+	if fallback == "" {
+		fallback = defaultSchedule
+	}
+	var specs []string
+	seen := make(map[string]bool)
+	for _, event := range sourceEvents(source) {
+		spec := schedules[event]
+		if spec == "" {
+			spec = fallback
+		}
+		if !seen[spec] {
+			seen[spec] = true
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		specs = append(specs, fallback)
+	}
+	return specs
+}
+
+// scanSource runs one journey scan with a fresh notification_config snapshot and queues the resulting notifications
+func scanSource(db *gorm.DB, source EventSource, queue *jobQueue, options pipelineOptions, logger *log.Logger) {
+	logger.Printf("Running journey %s", source.Name())
+	configs, err := loadNotificationConfigs(db)
+	if err != nil {
+		logger.Printf("Journey %s error: %v", source.Name(), err)
+		return
+	}
+	report := newRunReport()
+	// Scans are not cancelled on shutdown; serve waits for them to finish queueing
+	errs := runSource(context.Background(), db, source, options, configs, report, func(notifications []Notification) error {
+		_, err := queue.Enqueue(notifications)
+		return err
+	}, logger)
+	report.log(logger)
+	for i, err := range errs {
+		logger.Printf("Journey %s error %d: %v", source.Name(), i+1, err)
+	}
+}
+
+// serve scans every journey on its cron schedule, optionally classifies journey table inserts as they happen,
+// and continuously releases due jobs until ctx is cancelled; scans, sends and mirrors already in progress are
+// finished before it returns
+func serve(ctx context.Context, db *gorm.DB, journeys []EventSource, schedules map[string]string, queue *jobQueue,
+	dispatcher *Dispatcher, invalidTokens *invalidTokenReport, options pipelineOptions, pollInterval time.Duration,
+	listenInserts bool, logger *log.Logger) error {
+	scheduler := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
+	for _, source := range journeys {
+		source := source
+		// The schedules of a journey's events must not scan it twice at once
+		var scanning sync.Mutex
+		scan := func() {
+			if !scanning.TryLock() {
+				logger.Printf("Skipping journey %s: a scan is still running", source.Name())
+				return
+			}
+			defer scanning.Unlock()
+			scanSource(db, source, queue, options, logger)
+		}
+		for _, spec := range journeySchedules(source, schedules) {
+			if _, err := scheduler.AddFunc(spec, scan); err != nil {
+				return fmt.Errorf("invalid schedule %q for journey %s: %v", spec, source.Name(), err)
+			}
+			logger.Printf("Scheduled journey %s: %s", source.Name(), spec)
+		}
+	}
+	scheduler.Start()
+
+	listening := make(chan struct{})
+	if listenInserts {
+		go func() {
+			defer close(listening)
+			listen(ctx, db, journeys, queue, options, logger)
+		}()
+	} else {
+		close(listening)
+	}
+
+	// Release due jobs, picking up newly queued ones at least every poll interval
+	for ctx.Err() == nil {
+		_, errs := queue.Release(ctx, dispatcher, time.Now().Add(pollInterval))
+		for _, err := range errs {
+			logger.Printf("Error releasing notifications: %v", err)
+		}
+		invalidTokens.log(logger)
+		sleepUntil(ctx, time.Now().Add(pollInterval))
+	}
+
+	logger.Printf("Shutting down, waiting for running journey scans and mirrors")
+	<-scheduler.Stop().Done()
+	<-listening
+	dispatcher.waitForMirrors()
+	return nil
+}
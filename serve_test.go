@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJourneySchedules(t *testing.T) {
+	pan := ruleSource{rule: JourneyRule{Name: "pan", Events: []EventRule{{Event: "PAN_FORM_DROPOFF"}, {Event: "PAN_FAILURE"}}}}
+	tests := []struct {
+		name      string
+		source    EventSource
+		schedules map[string]string
+		want      []string
+	}{
+		{"nothing configured", pan, nil, []string{defaultSchedule}},
+		{"default", pan, map[string]string{"default": "@every 30m"}, []string{"@every 30m"}},
+		{"journey entry", pan, map[string]string{"default": "@every 30m", "pan": "@every 10m"}, []string{"@every 10m"}},
+		{"event entry", pan, map[string]string{"default": "@every 30m", "PAN_FAILURE": "*/5 * * * *"}, []string{"@every 30m", "*/5 * * * *"}},
+		{"event entries override the journey's", pan, map[string]string{"pan": "@every 10m", "PAN_FORM_DROPOFF": "@every 1h", "PAN_FAILURE": "@every 1h"}, []string{"@every 1h"}},
+		{"Go journey by event", creditCardRejectSource{}, map[string]string{"CREDIT_CARD_REJECTED": "*/5 * * * *"}, []string{"*/5 * * * *"}},
+		{"Go journey by name", arnGeneratedSource{}, map[string]string{"arn-generated": "*/5 * * * *"}, []string{"*/5 * * * *"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := journeySchedules(tt.source, tt.schedules); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("journeySchedules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultSMSGatewayParams are the request field names used unless SMS_GATEWAY_PARAMS overrides them
+var defaultSMSGatewayParams = map[string]string{
+	"to":          "to",
+	"text":        "text",
+	"header":      "sender",
+	"entity_id":   "entity_id",
+	"template_id": "template_id",
+}
+
+// httpSMSGateway is a generic HTTP SMS gateway (MSG91, Gupshup, Kaleyra style) configured by field mapping
+type httpSMSGateway struct {
+	name              string
+	url               string
+	authHeader        string
+	apiKey            string
+	form              bool              // Send application/x-www-form-urlencoded instead of JSON
+	params            map[string]string // Our field name -> gateway field name
+	messageIDField    string            // Top level response field holding the gateway message id
+	idempotencyHeader string            // Request header carrying the notification's idempotency key, if supported
+	client            *http.Client
+}
+
+// newHTTPSMSGateway builds a gateway; params is a comma separated list of field=gateway_field overrides
+func newHTTPSMSGateway(name, gatewayURL, authHeader, apiKey, format, params, messageIDField, idempotencyHeader string) (*httpSMSGateway, error) {
+	if gatewayURL == "" {
+		return nil, fmt.Errorf("SMS gateway URL must be set")
+	}
+	if name == "" {
+		name = "http"
+	}
+	if authHeader == "" {
+		authHeader = "Authorization"
+	}
+	if messageIDField == "" {
+		messageIDField = "message_id"
+	}
+	if format != "" && format != "json" && format != "form" {
+		return nil, fmt.Errorf("unknown SMS gateway format %q, expected json or form", format)
+	}
+
+	mapping := make(map[string]string, len(defaultSMSGatewayParams))
+	for field, gatewayField := range defaultSMSGatewayParams {
+		mapping[field] = gatewayField
+	}
+	if params != "" {
+		for _, pair := range strings.Split(params, ",") {
+			field, gatewayField, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if _, known := defaultSMSGatewayParams[field]; !ok || !known || gatewayField == "" {
+				return nil, fmt.Errorf("invalid SMS gateway param mapping %q", pair)
+			}
+			mapping[field] = gatewayField
+		}
+	}
+
+	return &httpSMSGateway{
+		name:              name,
+		url:               gatewayURL,
+		authHeader:        authHeader,
+		apiKey:            apiKey,
+		form:              format == "form",
+		params:            mapping,
+		messageIDField:    messageIDField,
+		idempotencyHeader: idempotencyHeader,
+		client:            &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Name identifies the gateway
+func (g *httpSMSGateway) Name() string { return g.name }
+
+// SendSMS posts the message with its DLT identifiers to the gateway
+func (g *httpSMSGateway) SendSMS(ctx context.Context, message smsMessage) (string, error) {
+	fields := map[string]string{
+		g.params["to"]:          message.To,
+		g.params["text"]:        message.Text,
+		g.params["header"]:      message.Header,
+		g.params["entity_id"]:   message.DLTEntityID,
+		g.params["template_id"]: message.DLTTemplateID,
+	}
+
+	var body io.Reader
+	contentType := "application/json"
+	if g.form {
+		values := url.Values{}
+		for key, value := range fields {
+			values.Set(key, value)
+		}
+		body = strings.NewReader(values.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	} else {
+		payload, err := json.Marshal(fields)
+		if err != nil {
+			return "", fmt.Errorf("error encoding SMS request: %v", err)
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if g.apiKey != "" {
+		req.Header.Set(g.authHeader, g.apiKey)
+	}
+	if g.idempotencyHeader != "" && message.IdempotencyKey != "" {
+		req.Header.Set(g.idempotencyHeader, message.IdempotencyKey)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling SMS gateway %s: %v", g.name, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("SMS gateway %s returned status %d: %s", g.name, resp.StatusCode, respBody)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(respBody, &decoded); err != nil {
+		// Some gateways answer with a plain text id
+		return strings.TrimSpace(string(respBody)), nil
+	}
+	if id, ok := decoded[g.messageIDField]; ok {
+		return fmt.Sprint(id), nil
+	}
+	return "", nil
+}
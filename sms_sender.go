@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dltVariable is the placeholder TRAI DLT uses for variable parts of a registered template
+const dltVariable = "{#var#}"
+
+// dltMaxVariableLength is the maximum number of characters DLT allows per variable
+const dltMaxVariableLength = 30
+
+// smsMessage is a rendered SMS ready to be handed to a gateway
+type smsMessage struct {
+	To             string
+	Text           string
+	Header         string // DLT registered sender id, e.g. "XYZBNK"
+	DLTEntityID    string
+	DLTTemplateID  string
+	IdempotencyKey string // Sent in the gateway's idempotency header when it has one
+}
+
+// smsProvider is implemented by every SMS gateway integration
+type smsProvider interface {
+	Name() string
+	SendSMS(ctx context.Context, message smsMessage) (string, error)
+}
+
+// dltTemplate is an SMS template as registered on the DLT platform
+type dltTemplate struct {
+	ID        string   `yaml:"id"`
+	Text      string   `yaml:"text"`      // Registered text with {#var#} placeholders
+	Variables []string `yaml:"variables"` // Notification metadata keys filling the placeholders, in order
+	Header    string   `yaml:"header"`    // Overrides the file level header
+
+	pattern *regexp.Regexp
+}
+
+// dltTemplates is the SMS templates file referenced by notification_config.dlt_template_id
+type dltTemplates struct {
+	EntityID  string        `yaml:"entity_id"`
+	Header    string        `yaml:"header"`
+	Templates []dltTemplate `yaml:"templates"`
+
+	byID map[string]*dltTemplate
+}
+
+// loadDLTTemplates reads and validates the SMS templates file
+func loadDLTTemplates(path string) (*dltTemplates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SMS templates file %s: %v", path, err)
+	}
+	var templates dltTemplates
+	if err := yaml.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("error parsing SMS templates file %s: %v", path, err)
+	}
+	if templates.EntityID == "" {
+		return nil, fmt.Errorf("SMS templates file %s has no entity_id", path)
+	}
+
+	templates.byID = make(map[string]*dltTemplate)
+	for i := range templates.Templates {
+		t := &templates.Templates[i]
+		if t.ID == "" || t.Text == "" {
+			return nil, fmt.Errorf("SMS template %d must have an id and text", i+1)
+		}
+		if n := strings.Count(t.Text, dltVariable); n != len(t.Variables) {
+			return nil, fmt.Errorf("SMS template %s has %d placeholders but %d variables", t.ID, n, len(t.Variables))
+		}
+		if t.Header == "" {
+			t.Header = templates.Header
+		}
+		t.pattern = dltPattern(t.Text)
+		templates.byID[t.ID] = t
+	}
+	return &templates, nil
+}
+
+// dltPattern compiles a registered template into a regexp matching any valid rendering
+func dltPattern(text string) *regexp.Regexp {
+	parts := strings.Split(text, dltVariable)
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, fmt.Sprintf("(.{1,%d})", dltMaxVariableLength)) + "$")
+}
+
+// render fills the template variables from the notification metadata and validates the result
+func (t *dltTemplate) render(metadata map[string]string) (string, error) {
+	text := t.Text
+	for _, variable := range t.Variables {
+		value := strings.TrimSpace(metadata[variable])
+		if value == "" {
+			return "", fmt.Errorf("SMS template %s: metadata %s is empty", t.ID, variable)
+		}
+		if utf8.RuneCountInString(value) > dltMaxVariableLength {
+			return "", fmt.Errorf("SMS template %s: metadata %s exceeds %d characters", t.ID, variable, dltMaxVariableLength)
+		}
+		text = strings.Replace(text, dltVariable, value, 1)
+	}
+	if !t.pattern.MatchString(text) {
+		return "", fmt.Errorf("rendered SMS does not match DLT template %s", t.ID)
+	}
+	return text, nil
+}
+
+// smsSender renders DLT templates and sends them through an SMS gateway
+type smsSender struct {
+	provider  smsProvider
+	templates *dltTemplates
+}
+
+// Name identifies the sender by its gateway
+func (s *smsSender) Name() string { return "sms:" + s.provider.Name() }
+
+// Send renders the notification's DLT template and sends it to the user's plain mobile number
+func (s *smsSender) Send(ctx context.Context, notification Notification) (string, error) {
+	if notification.PlainMobile == "" {
+		return "", fmt.Errorf("no plain mobile number for user_id %d", notification.UserID)
+	}
+	if notification.DLTTemplateID == "" {
+		return "", fmt.Errorf("notification_config for event %s has no dlt_template_id", notification.Event)
+	}
+	template, ok := s.templates.byID[notification.DLTTemplateID]
+	if !ok {
+		return "", fmt.Errorf("unknown DLT template %s for event %s", notification.DLTTemplateID, notification.Event)
+	}
+
+	text, err := template.render(notification.Metadata)
+	if err != nil {
+		return "", err
+	}
+	return s.provider.SendSMS(ctx, smsMessage{
+		To:             notification.PlainMobile,
+		Text:           text,
+		Header:         template.Header,
+		DLTEntityID:    s.templates.EntityID,
+		DLTTemplateID:  template.ID,
+		IdempotencyKey: notification.IdempotencyKey,
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDLTTemplates = `
+entity_id: "1101000000000000000"
+header: XYZBNK
+templates:
+  - id: "1107000000000000002"
+    text: "Dear {#var#}, your application reference number is {#var#}. - XYZ Bank"
+    variables: [Name, Arn]
+  - id: "1107000000000000003"
+    text: "Your OTP is {#var#}"
+    variables: [Otp]
+    header: XYZOTP
+`
+
+// smsRequest is a request received by the gateway stub
+type smsRequest struct {
+	contentType string
+	header      http.Header
+	fields      map[string]string
+}
+
+// newSMSStub starts a gateway stub answering every request with body and collecting the requests
+func newSMSStub(t *testing.T, body string) (*httptest.Server, chan smsRequest) {
+	t.Helper()
+	requests := make(chan smsRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := smsRequest{contentType: r.Header.Get("Content-Type"), header: r.Header, fields: make(map[string]string)}
+		data, _ := io.ReadAll(r.Body)
+		if request.contentType == "application/x-www-form-urlencoded" {
+			values, err := url.ParseQuery(string(data))
+			if err != nil {
+				t.Errorf("error parsing form body: %v", err)
+			}
+			for key := range values {
+				request.fields[key] = values.Get(key)
+			}
+		} else if err := json.Unmarshal(data, &request.fields); err != nil {
+			t.Errorf("error decoding JSON body %s: %v", data, err)
+		}
+		requests <- request
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// newTestSMSSender builds a sender for the test templates on the given gateway
+func newTestSMSSender(t *testing.T, gateway *httpSMSGateway) *smsSender {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sms_templates.yaml")
+	if err := os.WriteFile(path, []byte(testDLTTemplates), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := loadDLTTemplates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &smsSender{provider: gateway, templates: templates}
+}
+
+func testSMSNotification() Notification {
+	return Notification{
+		Event:          "ARN_GENERATED",
+		UserID:         42,
+		PlainMobile:    "9876543210",
+		Channel:        "sms",
+		DLTTemplateID:  "1107000000000000002",
+		IdempotencyKey: "0123456789abcdef",
+		Metadata:       map[string]string{"Name": "Asha", "Arn": "ARN123"},
+	}
+}
+
+func TestSMSSenderJSONDefaultFields(t *testing.T) {
+	server, requests := newSMSStub(t, `{"message_id": "gw-1", "status": "queued"}`)
+	gateway, err := newHTTPSMSGateway("msg91", server.URL, "", "secret", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestSMSSender(t, gateway)
+
+	messageID, err := sender.Send(context.Background(), testSMSNotification())
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if messageID != "gw-1" {
+		t.Errorf("message id = %q, want gw-1", messageID)
+	}
+	request := <-requests
+	if request.contentType != "application/json" {
+		t.Errorf("Content-Type = %q", request.contentType)
+	}
+	if auth := request.header.Get("Authorization"); auth != "secret" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	want := map[string]string{
+		"to":          "9876543210",
+		"text":        "Dear Asha, your application reference number is ARN123. - XYZ Bank",
+		"sender":      "XYZBNK",
+		"entity_id":   "1101000000000000000",
+		"template_id": "1107000000000000002",
+	}
+	for field, value := range want {
+		if request.fields[field] != value {
+			t.Errorf("field %s = %q, want %q", field, request.fields[field], value)
+		}
+	}
+	if len(request.fields) != len(want) {
+		t.Errorf("fields = %v, want %v", request.fields, want)
+	}
+}
+
+func TestSMSSenderFormMappedFields(t *testing.T) {
+	server, requests := newSMSStub(t, `{"request_id": 981, "type": "success"}`)
+	gateway, err := newHTTPSMSGateway("kaleyra", server.URL, "api-key", "secret", "form",
+		"to=mobiles, entity_id=DLT_TE_ID,template_id=DLT_CT_ID", "request_id", "Idempotency-Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestSMSSender(t, gateway)
+
+	notification := testSMSNotification()
+	notification.DLTTemplateID = "1107000000000000003"
+	notification.Metadata = map[string]string{"Otp": "123456"}
+	messageID, err := sender.Send(context.Background(), notification)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if messageID != "981" {
+		t.Errorf("message id = %q, want 981", messageID)
+	}
+	request := <-requests
+	if request.contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("Content-Type = %q", request.contentType)
+	}
+	if auth := request.header.Get("api-key"); auth != "secret" {
+		t.Errorf("api-key header = %q", auth)
+	}
+	if key := request.header.Get("Idempotency-Key"); key != "0123456789abcdef" {
+		t.Errorf("Idempotency-Key = %q", key)
+	}
+	want := map[string]string{
+		"mobiles":   "9876543210",
+		"text":      "Your OTP is 123456",
+		"sender":    "XYZOTP",
+		"DLT_TE_ID": "1101000000000000000",
+		"DLT_CT_ID": "1107000000000000003",
+	}
+	for field, value := range want {
+		if request.fields[field] != value {
+			t.Errorf("field %s = %q, want %q", field, request.fields[field], value)
+		}
+	}
+}
+
+func TestSMSGatewayMessageID(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+		want  string
+	}{
+		{"default field", `{"message_id": "abc"}`, "", "abc"},
+		{"custom field", `{"data": {}, "sid": "xyz"}`, "sid", "xyz"},
+		{"numeric id", `{"message_id": 12345}`, "", "12345"},
+		{"missing field", `{"status": "ok"}`, "", ""},
+		{"plain text id", "  5f3c2a1b\n", "", "5f3c2a1b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newSMSStub(t, tt.body)
+			gateway, err := newHTTPSMSGateway("", server.URL, "", "", "form", "", tt.field, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			messageID, err := gateway.SendSMS(context.Background(), smsMessage{To: "9876543210", Text: "hi"})
+			<-requests
+			if err != nil {
+				t.Fatalf("SendSMS: %v", err)
+			}
+			if messageID != tt.want {
+				t.Errorf("message id = %q, want %q", messageID, tt.want)
+			}
+		})
+	}
+}
+
+func TestSMSGatewayErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid template"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+	gateway, err := newHTTPSMSGateway("gupshup", server.URL, "", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateway.SendSMS(context.Background(), smsMessage{To: "9876543210", Text: "hi"}); err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("SendSMS error = %v, want the gateway status", err)
+	}
+}
+
+func TestSMSSenderRejectsTextNotMatchingTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     string
+	}{
+		{"empty variable", map[string]string{"Name": "Asha"}, "metadata Arn is empty"},
+		{"variable too long", map[string]string{"Name": strings.Repeat("A", dltMaxVariableLength+1), "Arn": "ARN123"}, "exceeds 30 characters"},
+		{"line break in variable", map[string]string{"Name": "Asha\nCall 1800 now", "Arn": "ARN123"}, "does not match DLT template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newSMSStub(t, `{"message_id": "gw-1"}`)
+			gateway, err := newHTTPSMSGateway("", server.URL, "", "", "", "", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender := newTestSMSSender(t, gateway)
+
+			notification := testSMSNotification()
+			notification.Metadata = tt.metadata
+			_, err = sender.Send(context.Background(), notification)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Send error = %v, want %q", err, tt.want)
+			}
+			if len(requests) != 0 {
+				t.Errorf("gateway called for a rejected SMS")
+			}
+		})
+	}
+}
+
+func TestLoadDLTTemplatesChecksVariables(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms_templates.yaml")
+	data := "entity_id: \"1\"\ntemplates:\n  - id: \"2\"\n    text: \"Dear {#var#}, ARN {#var#}\"\n    variables: [Name]\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDLTTemplates(path); err == nil || !strings.Contains(err.Error(), "2 placeholders but 1 variables") {
+		t.Errorf("loadDLTTemplates error = %v, want a placeholder count mismatch", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Candidate is a user detected by an event source as eligible for a journey notification
+type Candidate struct {
+	MobileNumber string            `json:"mobile_number"`
+	UserID       uint32            `json:"user_id"`    // Zero when the source only knows the mobile number
+	EventType    string            `json:"event_type"` // Matches notification_config.event_name
+	AnchorAt     time.Time         `json:"anchor_at"`  // Timestamp the configured delay is added to
+	Status       string            `json:"status"`     // Current journey status reported in the notification
+	Metadata     map[string]string `json:"metadata"`   // Event specific values merged into Notification.Metadata
+}
+
+// EventSource detects journey candidates; new journeys are added by implementing it and calling registerSource
+type EventSource interface {
+	// Name returns the subcommand name of the journey, e.g. "pan" or "arn-generated"
+	Name() string
+	// DefaultSource returns the notification source used when SOURCE is not set
+	DefaultSource() string
+	// Window returns the full scan window of the journey ending at now, scanned when it has no checkpoint
+	Window(now time.Time) scanWindow
+	// Fetch streams the candidates anchored within window to emit in batches of up to batchSize rows;
+	// emit blocks while the pipeline is busy and an emit error aborts the scan
+	Fetch(db *gorm.DB, window scanWindow, batchSize int, emit func([]Candidate) error) error
+}
+
+// scanWindow is the fixed time range of one journey scan, so every keyset batch sees the same rows
+type scanWindow struct {
+	Since   time.Time
+	Until   time.Time // Rows anchored at or after Until are left for the next scan
+	Mobiles []string  // When set, only rows of these mobile numbers are read (tableSource journeys)
+}
+
+// allMobiles reports whether the window covers every user rather than a few listened ones
+func (w scanWindow) allMobiles() bool { return len(w.Mobiles) == 0 }
+
+// newScanWindow covers the last lookbackDays up to now
+func newScanWindow(now time.Time, lookbackDays int) scanWindow {
+	return scanWindow{Since: now.Add(-time.Duration(lookbackDays) * 24 * time.Hour), Until: now}
+}
+
+// tableSource is implemented by journeys that classify fresh inserts into one table and can therefore be
+// triggered in real time by the listener
+type tableSource interface {
+	EventSource
+	// Table returns the table whose inserts can make a user a candidate, e.g. "flow_statuses"
+	Table() string
+}
+
+// sources holds the registered event sources in registration order
+var sources []EventSource
+
+// registerSource adds an event source to the shared pipeline
+func registerSource(source EventSource) {
+	for _, existing := range sources {
+		if existing.Name() == source.Name() {
+			panic(fmt.Sprintf("event source %s registered twice", source.Name()))
+		}
+	}
+	sources = append(sources, source)
+}
+
+// findSource looks up a registered event source by subcommand name
+func findSource(name string) (EventSource, bool) {
+	for _, source := range sources {
+		if source.Name() == name {
+			return source, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testSchema creates the journey tables the event sources read
+const testSchema = `
+	CREATE TABLE users (id BIGINT PRIMARY KEY, mobile_number TEXT, full_name TEXT, plain_mobile_number TEXT, email TEXT);
+	CREATE TABLE flow_statuses (id BIGSERIAL PRIMARY KEY, mobile_number TEXT, status TEXT, created_at TIMESTAMPTZ);
+	CREATE TABLE card_statuses (id BIGSERIAL PRIMARY KEY, mobile_number TEXT, status TEXT, reasons TEXT, created_at TIMESTAMPTZ);
+	CREATE TABLE arns (id BIGSERIAL PRIMARY KEY, phone_number TEXT, arn TEXT, created_at TIMESTAMPTZ);
+	CREATE TABLE user_level_histories (id BIGSERIAL PRIMARY KEY, user_id BIGINT, user_level TEXT, updated_at TIMESTAMPTZ);
+`
+
+// testDB connects to DATABASE_URL and creates the journey tables in a schema of their own, dropped when the test
+// ends; tests using it are skipped when DATABASE_URL is not set
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	db, err := gorm.Open(postgres.Open(dbURL), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single connection keeps the search_path for every query of the test
+	sqlDB.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("comms_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE")
+		sqlDB.Close()
+	})
+	for _, statement := range []string{"CREATE SCHEMA " + schema, "SET search_path TO " + schema, testSchema} {
+		if err := db.Exec(statement).Error; err != nil {
+			t.Fatalf("error creating test schema: %v", err)
+		}
+	}
+	return db
+}
+
+// testMobile is the mobile number of the i-th test user
+func testMobile(i int) string {
+	return fmt.Sprintf("98%08d", i)
+}
+
+// keysetCase inserts rows that make the i-th test user a candidate of source, anchored at the given time
+type keysetCase struct {
+	source EventSource
+	insert func(db *gorm.DB, i int, anchorAt time.Time) error
+}
+
+// keysetCases covers every keyset paginated journey scan
+func keysetCases() []keysetCase {
+	insertUser := func(db *gorm.DB, i int) error {
+		return db.Exec(`INSERT INTO users (id, mobile_number, full_name) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+			i+1, testMobile(i), fmt.Sprintf("User %d", i)).Error
+	}
+	return []keysetCase{
+		{
+			source: ruleSource{rule: JourneyRule{
+				Name:         "pan",
+				Table:        "flow_statuses",
+				AnchorColumn: "created_at",
+				Events:       []EventRule{{Event: "PAN_FORM_DROPOFF", TriggerStatuses: []string{"PAN_FORM_START"}}},
+			}},
+			insert: func(db *gorm.DB, i int, anchorAt time.Time) error {
+				return db.Exec(`INSERT INTO flow_statuses (mobile_number, status, created_at) VALUES (?, 'PAN_FORM_START', ?)`,
+					testMobile(i), anchorAt).Error
+			},
+		},
+		{
+			source: creditCardRejectSource{},
+			insert: func(db *gorm.DB, i int, anchorAt time.Time) error {
+				return db.Exec(`INSERT INTO card_statuses (mobile_number, status, reasons, created_at) VALUES (?, 'DECLINED', 'LOW_SCORE', ?)`,
+					testMobile(i), anchorAt).Error
+			},
+		},
+		{
+			source: arnGeneratedSource{},
+			insert: func(db *gorm.DB, i int, anchorAt time.Time) error {
+				return db.Exec(`INSERT INTO arns (phone_number, arn, created_at) VALUES (?, ?, ?)`,
+					testMobile(i), fmt.Sprintf("ARN%06d", i), anchorAt).Error
+			},
+		},
+		{
+			source: arnNotGeneratedSource{},
+			insert: func(db *gorm.DB, i int, anchorAt time.Time) error {
+				return db.Exec(`INSERT INTO flow_statuses (mobile_number, status, created_at) VALUES (?, 'LOS_COMPLETED', ?)`,
+					testMobile(i), anchorAt).Error
+			},
+		},
+		{
+			source: cardDropoffSource{},
+			insert: func(db *gorm.DB, i int, anchorAt time.Time) error {
+				if err := insertUser(db, i); err != nil {
+					return err
+				}
+				return db.Exec(`INSERT INTO user_level_histories (user_id, user_level, updated_at) VALUES (?, '3', ?)`,
+					i+1, anchorAt).Error
+			},
+		},
+	}
+}
+
+// TestKeysetScansWithInsertsMidScan pages every journey scan in small batches while rows are inserted between
+// batches: rows already in the table are returned exactly once, rows inserted ahead of the keyset cursor are picked
+// up, and rows inserted behind it shift nothing (OFFSET paging would return a row twice)
+func TestKeysetScansWithInsertsMidScan(t *testing.T) {
+	const existing = 25
+	const batchSize = 4
+
+	for _, tc := range keysetCases() {
+		t.Run(tc.source.Name(), func(t *testing.T) {
+			db := testDB(t)
+			// Old enough for the 48 hour journey; two rows share every anchor to exercise the tie-breaker
+			base := time.Now().Add(-72 * time.Hour).Truncate(time.Second)
+			window := scanWindow{Since: base.Add(-time.Hour), Until: base.Add(2 * time.Hour)}
+			anchorOf := func(i int) time.Time { return base.Add(time.Duration(i/2) * time.Minute) }
+
+			want := make(map[string]time.Time)
+			for i := 0; i < existing; i++ {
+				if err := tc.insert(db, i, anchorOf(i)); err != nil {
+					t.Fatalf("error inserting row %d: %v", i, err)
+				}
+				want[testMobile(i)] = anchorOf(i)
+			}
+
+			seen := make(map[string]int)
+			batches := 0
+			err := tc.source.Fetch(db, window, batchSize, func(batch []Candidate) error {
+				batches++
+				for _, candidate := range batch {
+					seen[candidate.MobileNumber]++
+					if anchorAt, ok := want[candidate.MobileNumber]; ok && !candidate.AnchorAt.Equal(anchorAt) {
+						t.Errorf("candidate %s anchored at %s, want %s", candidate.MobileNumber, candidate.AnchorAt, anchorAt)
+					}
+				}
+				if batches != 2 {
+					return nil
+				}
+				// Behind the cursor: anchors before the window's first row and anchors already paged past
+				behind := map[int]time.Time{200: base.Add(-30 * time.Minute), 201: base, 202: anchorOf(3)}
+				// Ahead of the cursor: the cursor's anchor with a larger key, and later anchors within the window
+				ahead := map[int]time.Time{900: anchorOf(7), 901: base.Add(time.Hour), 902: base.Add(time.Hour + time.Minute)}
+				for i, anchorAt := range behind {
+					if err := tc.insert(db, i, anchorAt); err != nil {
+						return err
+					}
+				}
+				for i, anchorAt := range ahead {
+					if err := tc.insert(db, i, anchorAt); err != nil {
+						return err
+					}
+					want[testMobile(i)] = anchorAt
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Fetch: %v", err)
+			}
+
+			for mobile := range want {
+				if seen[mobile] != 1 {
+					t.Errorf("candidate %s returned %d times, want once", mobile, seen[mobile])
+				}
+			}
+			for mobile, count := range seen {
+				if count > 1 {
+					t.Errorf("candidate %s returned %d times", mobile, count)
+				}
+			}
+			if batches < existing/batchSize {
+				t.Errorf("scan took %d batches, want at least %d", batches, existing/batchSize)
+			}
+		})
+	}
+}
+
+// TestCreditCardRejectPagesRowsDifferingOnlyInReasons keeps rows with the same timestamp and mobile number but
+// different reasons when they straddle a page boundary
+func TestCreditCardRejectPagesRowsDifferingOnlyInReasons(t *testing.T) {
+	db := testDB(t)
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, reasons := range []string{"LOW_SCORE", "AGE", "INCOME"} {
+		if err := db.Exec(`INSERT INTO card_statuses (mobile_number, status, reasons, created_at) VALUES (?, 'DECLINED', ?, ?)`,
+			testMobile(1), reasons, createdAt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]int)
+	window := scanWindow{Since: createdAt.Add(-time.Hour), Until: createdAt.Add(time.Hour)}
+	err := creditCardRejectSource{}.Fetch(db, window, 1, func(batch []Candidate) error {
+		for _, candidate := range batch {
+			seen[candidate.Metadata["Reasons"]]++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	for _, reasons := range []string{"LOW_SCORE", "AGE", "INCOME"} {
+		if seen[reasons] != 1 {
+			t.Errorf("reasons %s returned %d times, want once", reasons, seen[reasons])
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NotificationStatusRecord is a row written to notification_status for every delivery
+type NotificationStatusRecord struct {
+	UserID         uint32
+	EventName      string
+	Attempt        int
+	Channel        string
+	MessageID      string
+	IdempotencyKey string
+	Status         string
+	SentAt         *time.Time // Nil unless the provider accepted the notification
+	Error          string
+	SupersededBy   string
+	AnchorAt       *time.Time // Journey timestamp of the notification, used to tell whether the user converted since
+	UpdatedAt      time.Time
+}
+
+// statusRecorder persists delivery results so the next run advances to the following attempt
+type statusRecorder struct {
+	db *gorm.DB
+}
+
+// Record writes the result's notification_status row in its own transaction
+func (r *statusRecorder) Record(result DeliveryResult) error {
+	switch result.Status {
+	case deliverySent, deliveryFailed, deliverySuperseded, deliverySuppressed, deliveryCapped, deliveryExhausted:
+	default:
+		return nil
+	}
+
+	now := time.Now()
+	record := NotificationStatusRecord{
+		UserID:         result.Notification.UserID,
+		EventName:      result.Notification.Event,
+		Attempt:        result.Notification.Attempt,
+		Channel:        result.Notification.Channel,
+		MessageID:      result.MessageID,
+		IdempotencyKey: result.Notification.IdempotencyKey,
+		Status:         result.Status,
+		SupersededBy:   result.SupersededBy,
+		UpdatedAt:      now,
+	}
+	if result.Status == deliverySent {
+		record.SentAt = &now
+	}
+	if anchorAt := result.Notification.AnchorAt; !anchorAt.IsZero() {
+		record.AnchorAt = &anchorAt
+	}
+	if result.Err != nil {
+		record.Error = result.Err.Error()
+	}
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// A notification re-sent after a crash keeps its first sent row, and a user is exhausted once per event
+		return tx.Table("notification_status").Clauses(clause.OnConflict{DoNothing: true}).Create(&record).Error
+	})
+	if err != nil {
+		log.Printf("Error recording notification status for user_id %d, event %s, attempt %d: %v", record.UserID, record.EventName, record.Attempt, err)
+		return fmt.Errorf("error recording notification status for user_id %d, event %s, attempt %d: %v", record.UserID, record.EventName, record.Attempt, err)
+	}
+	return nil
+}
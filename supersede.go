@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// supersedeRule lists the statuses that make a queued notification of one event stale
+type supersedeRule struct {
+	Table         string
+	AnchorColumn  string
+	NotFollowedBy []string // Stale once one of these is reached at or after the notification's anchor
+	NeverReached  []string // Stale once one of these is reached at all
+	LatestOnly    bool     // Stale once any later row exists, as the triggering row is no longer the latest
+}
+
+// revalidatingSource is implemented by Go journeys whose queued notifications can go stale, checked right before
+// every send of their event
+type revalidatingSource interface {
+	EventSource
+	// Event returns the event the journey emits
+	Event() string
+	// SupersededBy returns the status that made the notification stale, or "" when it is still due
+	SupersededBy(db *gorm.DB, notification Notification) (string, error)
+}
+
+// supersedeRules maps event names to their rule; set from the journey rules by registerRules
+var supersedeRules map[string]supersedeRule
+
+// newSupersedeRules collects the not_followed_by and never_reached statuses and latest_only flag of every journey
+// event, so a send re-checks the same conditions that queued it
+func newSupersedeRules(journeys []JourneyRule) map[string]supersedeRule {
+	rules := make(map[string]supersedeRule)
+	for _, journey := range journeys {
+		for _, event := range journey.Events {
+			if len(event.NotFollowedBy) == 0 && len(event.NeverReached) == 0 && !journey.LatestOnly {
+				continue
+			}
+			if _, exists := rules[event.Event]; exists {
+				log.Printf("Event %s is used by several journeys, re-validating it with the first", event.Event)
+				continue
+			}
+			rules[event.Event] = supersedeRule{
+				Table:         journey.Table,
+				AnchorColumn:  journey.AnchorColumn,
+				NotFollowedBy: event.NotFollowedBy,
+				NeverReached:  event.NeverReached,
+				LatestOnly:    journey.LatestOnly,
+			}
+		}
+	}
+	return rules
+}
+
+// supersededBy re-checks the journey table right before a send and returns the status that made the
+// notification stale, e.g. a PAN_FORM row after a PAN_FORM_DROPOFF nudge was queued, or "" when it is still due
+func supersededBy(db *gorm.DB, notification Notification) (string, error) {
+	for _, source := range sources {
+		if revalidating, ok := source.(revalidatingSource); ok && revalidating.Event() == notification.Event {
+			return revalidating.SupersededBy(db, notification)
+		}
+	}
+	rule, ok := supersedeRules[notification.Event]
+	if !ok {
+		return "", nil
+	}
+	var statuses []string
+	query := fmt.Sprintf(`
+		SELECT status FROM %[1]s
+		WHERE mobile_number = ?
+		AND ((status IN ? AND %[2]s >= ?) OR status IN ? OR (?::boolean AND %[2]s > ?))
+		ORDER BY %[2]s DESC
+		LIMIT 1
+	`, rule.Table, rule.AnchorColumn)
+	err := db.Raw(query, notification.Mobile, rule.NotFollowedBy, notification.AnchorAt, rule.NeverReached,
+		rule.LatestOnly, notification.AnchorAt).Scan(&statuses).Error
+	if err != nil {
+		log.Printf("Error re-validating %s for user_id %d: %v", notification.Event, notification.UserID, err)
+		return "", fmt.Errorf("error re-validating %s for user_id %d: %v", notification.Event, notification.UserID, err)
+	}
+	if len(statuses) == 0 {
+		return "", nil
+	}
+	return statuses[0], nil
+}
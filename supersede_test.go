@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSupersedeRulesCoversLatestOnlyEvents(t *testing.T) {
+	rules := newSupersedeRules([]JourneyRule{
+		{Name: "failures", Table: "flow_statuses", AnchorColumn: "created_at", LatestOnly: true,
+			Events: []EventRule{{Event: "PAN_FAILURE", TriggerStatuses: []string{"PAN_REJECT"}}}},
+		{Name: "vkyc", Table: "flow_statuses", AnchorColumn: "created_at",
+			Events: []EventRule{
+				{Event: "VKYC_DROPOFF", TriggerStatuses: []string{"DELIVERY_ADDRESS"}, NeverReached: []string{"VKYC_DONE"}},
+				{Event: "VKYC_FAILURE", TriggerStatuses: []string{"VKYC_REJECT"}},
+			}},
+	})
+	if rule, ok := rules["PAN_FAILURE"]; !ok || !rule.LatestOnly {
+		t.Errorf("PAN_FAILURE rule = %+v, %v, want a latest_only rule", rule, ok)
+	}
+	if rule, ok := rules["VKYC_DROPOFF"]; !ok || rule.LatestOnly || len(rule.NeverReached) != 1 {
+		t.Errorf("VKYC_DROPOFF rule = %+v, %v, want its never_reached statuses", rule, ok)
+	}
+	if _, ok := rules["VKYC_FAILURE"]; ok {
+		t.Errorf("VKYC_FAILURE has a rule without any condition to re-check")
+	}
+}
+
+func TestSupersededBy(t *testing.T) {
+	db := testDB(t)
+	previous := supersedeRules
+	defer func() { supersedeRules = previous }()
+	supersedeRules = newSupersedeRules([]JourneyRule{
+		{Name: "failures", Table: "flow_statuses", AnchorColumn: "created_at", LatestOnly: true,
+			Events: []EventRule{{Event: "PAN_FAILURE", TriggerStatuses: []string{"PAN_REJECT"}}}},
+	})
+	anchorAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name         string
+		notification Notification
+		setup        string // Rows inserted before the notification is due
+		later        string // Rows that make it stale
+		want         string
+	}{
+		{
+			name:         "latest_only rule",
+			notification: Notification{Event: "PAN_FAILURE", UserID: 1, Mobile: testMobile(0), AnchorAt: anchorAt},
+			setup:        `INSERT INTO flow_statuses (mobile_number, status, created_at) VALUES ('9800000000', 'PAN_REJECT', ?)`,
+			later:        `INSERT INTO flow_statuses (mobile_number, status, created_at) VALUES ('9800000000', 'PAN_FORM', ?::timestamptz + interval '1 minute')`,
+			want:         "PAN_FORM",
+		},
+		{
+			name:         "card dropoff",
+			notification: Notification{Event: "card_details_dropoff", UserID: 2, Mobile: testMobile(1), AnchorAt: anchorAt},
+			setup:        `INSERT INTO user_level_histories (user_id, user_level, updated_at) VALUES (2, '3', ?)`,
+			later:        `INSERT INTO user_level_histories (user_id, user_level, updated_at) VALUES (2, '4', ?::timestamptz + interval '1 minute')`,
+			want:         "USER_LEVEL_4",
+		},
+		{
+			name:         "arn not generated",
+			notification: Notification{Event: "ARN_NOT_GENERATED_POST_APPLICATION_COMPLETE_in_48HOURS", UserID: 3, Mobile: testMobile(2), AnchorAt: anchorAt},
+			setup:        `INSERT INTO flow_statuses (mobile_number, status, created_at) VALUES ('9800000002', 'LOS_COMPLETED', ?)`,
+			later:        `INSERT INTO arns (phone_number, arn, created_at) VALUES ('9800000002', 'ARN000002', ?::timestamptz + interval '1 minute')`,
+			want:         "ARN_GENERATED",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := db.Exec(tt.setup, anchorAt).Error; err != nil {
+				t.Fatal(err)
+			}
+			if status, err := supersededBy(db, tt.notification); err != nil || status != "" {
+				t.Fatalf("supersededBy before progress = %q, %v, want still due", status, err)
+			}
+			if err := db.Exec(tt.later, anchorAt).Error; err != nil {
+				t.Fatal(err)
+			}
+			if status, err := supersededBy(db, tt.notification); err != nil || status != tt.want {
+				t.Errorf("supersededBy after progress = %q, %v, want %q", status, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebhookEndpoint represents a row of notification_webhooks
+type WebhookEndpoint struct {
+	ID             int
+	EventName      string // Empty or "*" matches every event
+	Channel        string // Empty or "*" matches every channel
+	URL            string
+	Secret         string
+	TimeoutMs      int
+	MaxRetries     int
+	MaxConcurrency int
+}
+
+// matches reports whether the endpoint wants notifications of this event and channel
+func (e WebhookEndpoint) matches(notification Notification) bool {
+	eventMatches := e.EventName == "" || e.EventName == "*" || e.EventName == notification.Event
+	channelMatches := e.Channel == "" || e.Channel == "*" || normalizeChannel(e.Channel) == normalizeChannel(notification.Channel)
+	return eventMatches && channelMatches
+}
+
+// fetchWebhookEndpoints loads the enabled endpoints from notification_webhooks
+func fetchWebhookEndpoints(db *gorm.DB) ([]WebhookEndpoint, error) {
+	var endpoints []WebhookEndpoint
+	err := db.Table("notification_webhooks").
+		Select("id, event_name, channel, url, secret, timeout_ms, max_retries, max_concurrency").
+		Where("enabled").
+		Order("id").
+		Scan(&endpoints).Error
+	if err != nil {
+		log.Printf("Error fetching webhook endpoints: %v", err)
+		return nil, fmt.Errorf("error fetching webhook endpoints: %v", err)
+	}
+	return endpoints, nil
+}
+
+// webhookTarget is an endpoint with its concurrency limiter
+type webhookTarget struct {
+	endpoint WebhookEndpoint
+	client   *http.Client
+	slots    chan struct{}
+}
+
+// webhookSender POSTs signed notification JSON to every matching endpoint
+type webhookSender struct {
+	targets     []*webhookTarget
+	baseBackoff time.Duration
+	maxBackoff  time.Duration // Caps the doubling, which would overflow for a large max_retries
+}
+
+// newWebhookSender prepares a sender for the given endpoints, applying defaults for unset limits
+func newWebhookSender(endpoints []WebhookEndpoint) *webhookSender {
+	sender := &webhookSender{baseBackoff: 500 * time.Millisecond, maxBackoff: 30 * time.Second}
+	for _, endpoint := range endpoints {
+		if endpoint.TimeoutMs <= 0 {
+			endpoint.TimeoutMs = 5000
+		}
+		if endpoint.MaxConcurrency <= 0 {
+			endpoint.MaxConcurrency = 4
+		}
+		if endpoint.MaxRetries < 0 {
+			endpoint.MaxRetries = 0
+		}
+		sender.targets = append(sender.targets, &webhookTarget{
+			endpoint: endpoint,
+			client:   &http.Client{Timeout: time.Duration(endpoint.TimeoutMs) * time.Millisecond},
+			slots:    make(chan struct{}, endpoint.MaxConcurrency),
+		})
+	}
+	return sender
+}
+
+// Name identifies the sender
+func (s *webhookSender) Name() string { return "webhook" }
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send posts the notification to all matching endpoints concurrently; it fails if any endpoint fails
+func (s *webhookSender) Send(ctx context.Context, notification Notification) (string, error) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return "", fmt.Errorf("error encoding notification: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var delivered []string
+	var errs []string
+	for _, target := range s.targets {
+		if !target.endpoint.matches(notification) {
+			continue
+		}
+		wg.Add(1)
+		go func(target *webhookTarget) {
+			defer wg.Done()
+			err := s.post(ctx, target, body, notification.IdempotencyKey)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("endpoint %d: %v", target.endpoint.ID, err))
+			} else {
+				delivered = append(delivered, strconv.Itoa(target.endpoint.ID))
+			}
+		}(target)
+	}
+	wg.Wait()
+
+	if len(delivered) == 0 && len(errs) == 0 {
+		return "", fmt.Errorf("%w: no webhook endpoint configured for event %s, channel %s", errNotApplicable, notification.Event, notification.Channel)
+	}
+	if len(errs) > 0 {
+		return "", fmt.Errorf("webhook delivery failed: %s", strings.Join(errs, "; "))
+	}
+	return "webhook:" + strings.Join(delivered, ","), nil
+}
+
+// post delivers the body to one endpoint, retrying network errors, 429 and 5xx with exponential backoff
+func (s *webhookSender) post(ctx context.Context, target *webhookTarget, body []byte, idempotencyKey string) error {
+	// Respect the per-endpoint concurrency limit
+	select {
+	case target.slots <- struct{}{}:
+		defer func() { <-target.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= target.endpoint.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepUntil(ctx, time.Now().Add(s.backoff(attempt))); err != nil {
+				return err
+			}
+		}
+
+		retry, err := s.postOnce(ctx, target, body, idempotencyKey)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+		log.Printf("Webhook endpoint %d attempt %d failed, retrying: %v", target.endpoint.ID, attempt+1, err)
+	}
+	return lastErr
+}
+
+// backoff returns the wait before the given retry: baseBackoff doubled per retry up to maxBackoff, plus up to half
+// of it as jitter
+func (s *webhookSender) backoff(attempt int) time.Duration {
+	backoff := s.baseBackoff
+	for i := 1; i < attempt && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.maxBackoff {
+		backoff = s.maxBackoff
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// postOnce makes a single signed request and reports whether a failure is worth retrying
+func (s *webhookSender) postOnce(ctx context.Context, target *webhookTarget, body []byte, idempotencyKey string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Comms-Timestamp", timestamp)
+	if target.endpoint.Secret != "" {
+		req.Header.Set("X-Comms-Signature", "sha256="+signWebhook(target.endpoint.Secret, timestamp, body))
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := target.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebhookStub starts an endpoint answering the i-th request (from 0) with statuses[i], or 200 past the end
+func newWebhookStub(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := int(requests.Add(1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestWebhookSenderSignsRequests(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+	}))
+	defer server.Close()
+
+	sender := newWebhookSender([]WebhookEndpoint{{ID: 3, URL: server.URL, Secret: "s3cret"}})
+	messageID, err := sender.Send(context.Background(), Notification{UserID: 1, Event: "ARN_GENERATED", Channel: "sms", IdempotencyKey: "key-1"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if messageID != "webhook:3" {
+		t.Errorf("message id = %s, want webhook:3", messageID)
+	}
+
+	received := <-requests
+	timestamp := received.header.Get("X-Comms-Timestamp")
+	if want := "sha256=" + signWebhook("s3cret", timestamp, received.body); received.header.Get("X-Comms-Signature") != want {
+		t.Errorf("X-Comms-Signature = %s, want %s", received.header.Get("X-Comms-Signature"), want)
+	}
+	if received.header.Get("Idempotency-Key") != "key-1" || received.header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers = %v, want Idempotency-Key key-1 and JSON content type", received.header)
+	}
+}
+
+func TestWebhookSenderRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int32
+		wantErr      bool
+	}{
+		{"5xx then success", []int{http.StatusServiceUnavailable, http.StatusBadGateway}, 3, false},
+		{"429 then success", []int{http.StatusTooManyRequests}, 2, false},
+		{"4xx is not retried", []int{http.StatusBadRequest}, 1, true},
+		{"retries exhausted", []int{500, 500, 500, 500}, 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newWebhookStub(t, tt.statuses...)
+			sender := newWebhookSender([]WebhookEndpoint{{ID: 1, URL: server.URL, MaxRetries: 3}})
+			sender.baseBackoff = time.Millisecond
+			_, err := sender.Send(context.Background(), Notification{Event: "ARN_GENERATED"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Send error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("endpoint received %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestWebhookSenderLimitsConcurrency(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	sender := newWebhookSender([]WebhookEndpoint{{ID: 1, URL: server.URL, MaxConcurrency: 2}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sender.Send(context.Background(), Notification{Event: "ARN_GENERATED"}); err != nil {
+				t.Errorf("Send: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max := maxInFlight.Load(); max != 2 {
+		t.Errorf("at most %d requests were in flight, want 2", max)
+	}
+}
+
+func TestWebhookSenderBackoffIsClamped(t *testing.T) {
+	sender := newWebhookSender(nil)
+	for _, attempt := range []int{1, 10, 36, 64, 1000} {
+		backoff := sender.backoff(attempt)
+		if backoff < sender.baseBackoff || backoff > sender.maxBackoff*3/2 {
+			t.Errorf("backoff(%d) = %s, want between %s and %s", attempt, backoff, sender.baseBackoff, sender.maxBackoff*3/2)
+		}
+	}
+}
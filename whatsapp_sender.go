@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// metadataPlaceholder matches {Key} references to notification metadata in template values
+var metadataPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// whatsappButton is a dynamic button parameter of an approved template
+type whatsappButton struct {
+	Type  string `yaml:"type"`  // quick_reply or url
+	Index int    `yaml:"index"` // Position of the button in the approved template
+	Value string `yaml:"value"` // Quick reply payload or URL suffix; {Key} is replaced from metadata
+}
+
+// whatsappTemplate maps a journey event to an approved WhatsApp template
+type whatsappTemplate struct {
+	Event          string           `yaml:"event"`
+	Name           string           `yaml:"name"`
+	Language       string           `yaml:"language"`
+	BodyParameters []string         `yaml:"body_parameters"` // Metadata keys, in template order
+	Buttons        []whatsappButton `yaml:"buttons"`
+}
+
+// whatsappTemplates is the WhatsApp templates file
+type whatsappTemplates struct {
+	Language  string             `yaml:"language"`
+	Templates []whatsappTemplate `yaml:"templates"`
+
+	byEvent map[string]*whatsappTemplate
+}
+
+// loadWhatsAppTemplates reads and validates the WhatsApp templates file
+func loadWhatsAppTemplates(path string) (*whatsappTemplates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WhatsApp templates file %s: %v", path, err)
+	}
+	var templates whatsappTemplates
+	if err := yaml.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("error parsing WhatsApp templates file %s: %v", path, err)
+	}
+	if templates.Language == "" {
+		templates.Language = "en"
+	}
+
+	templates.byEvent = make(map[string]*whatsappTemplate)
+	for i := range templates.Templates {
+		t := &templates.Templates[i]
+		if t.Event == "" || t.Name == "" {
+			return nil, fmt.Errorf("WhatsApp template %d must have an event and name", i+1)
+		}
+		if t.Language == "" {
+			t.Language = templates.Language
+		}
+		for _, button := range t.Buttons {
+			if button.Type != "quick_reply" && button.Type != "url" {
+				return nil, fmt.Errorf("WhatsApp template %s: unknown button type %q", t.Name, button.Type)
+			}
+		}
+		templates.byEvent[t.Event] = t
+	}
+	return &templates, nil
+}
+
+// expandMetadata replaces {Key} references with notification metadata values
+func expandMetadata(value string, metadata map[string]string) string {
+	return metadataPlaceholder.ReplaceAllStringFunc(value, func(match string) string {
+		return metadata[match[1:len(match)-1]]
+	})
+}
+
+// components builds the template components for a notification
+func (t *whatsappTemplate) components(metadata map[string]string) ([]map[string]interface{}, error) {
+	var components []map[string]interface{}
+	if len(t.BodyParameters) > 0 {
+		parameters := make([]map[string]string, 0, len(t.BodyParameters))
+		for _, key := range t.BodyParameters {
+			value := strings.TrimSpace(metadata[key])
+			if value == "" {
+				return nil, fmt.Errorf("WhatsApp template %s: metadata %s is empty", t.Name, key)
+			}
+			parameters = append(parameters, map[string]string{"type": "text", "text": value})
+		}
+		components = append(components, map[string]interface{}{"type": "body", "parameters": parameters})
+	}
+
+	for _, button := range t.Buttons {
+		parameter := map[string]string{"type": "text", "text": expandMetadata(button.Value, metadata)}
+		if button.Type == "quick_reply" {
+			parameter = map[string]string{"type": "payload", "payload": expandMetadata(button.Value, metadata)}
+		}
+		components = append(components, map[string]interface{}{
+			"type":       "button",
+			"sub_type":   button.Type,
+			"index":      strconv.Itoa(button.Index),
+			"parameters": []map[string]string{parameter},
+		})
+	}
+	return components, nil
+}
+
+// whatsappSender sends approved template messages through the WhatsApp Cloud API
+type whatsappSender struct {
+	endpoint      string // Graph API base URL including version
+	phoneNumberID string
+	accessToken   string
+	countryCode   string // Prefixed to 10 digit numbers
+	templates     *whatsappTemplates
+	client        *http.Client
+}
+
+// newWhatsAppSender creates a WhatsApp Cloud API sender
+func newWhatsAppSender(endpoint, phoneNumberID, accessToken, countryCode string, templates *whatsappTemplates) (*whatsappSender, error) {
+	if phoneNumberID == "" || accessToken == "" {
+		return nil, fmt.Errorf("WhatsApp phone number id and access token must be set")
+	}
+	if endpoint == "" {
+		endpoint = "https://graph.facebook.com/v19.0"
+	}
+	if countryCode == "" {
+		countryCode = "91"
+	}
+	return &whatsappSender{
+		endpoint:      strings.TrimRight(endpoint, "/"),
+		phoneNumberID: phoneNumberID,
+		accessToken:   accessToken,
+		countryCode:   countryCode,
+		templates:     templates,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Name identifies the sender
+func (s *whatsappSender) Name() string { return "whatsapp" }
+
+// recipient formats the plain mobile number as a WhatsApp id with country code
+func (s *whatsappSender) recipient(plainMobile string) string {
+	number := strings.TrimPrefix(strings.TrimSpace(plainMobile), "+")
+	if len(number) == 10 {
+		number = s.countryCode + number
+	}
+	return number
+}
+
+// Send sends the event's approved template and returns the WhatsApp message id
+func (s *whatsappSender) Send(ctx context.Context, notification Notification) (string, error) {
+	if notification.PlainMobile == "" {
+		return "", fmt.Errorf("no plain mobile number for user_id %d", notification.UserID)
+	}
+	template, ok := s.templates.byEvent[notification.Event]
+	if !ok {
+		return "", fmt.Errorf("no WhatsApp template for event %s", notification.Event)
+	}
+	components, err := template.components(notification.Metadata)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                s.recipient(notification.PlainMobile),
+		"type":              "template",
+		"template": map[string]interface{}{
+			"name":       template.Name,
+			"language":   map[string]string{"code": template.Language},
+			"components": components,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error encoding WhatsApp message: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s/messages", s.endpoint, s.phoneNumberID), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling WhatsApp Cloud API: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	var response struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+		Error struct {
+			Message string `json:"message"`
+			Code    int    `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("WhatsApp Cloud API returned status %d: %s", resp.StatusCode, body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("WhatsApp Cloud API returned status %d: code %d: %s", resp.StatusCode, response.Error.Code, response.Error.Message)
+	}
+	if len(response.Messages) == 0 {
+		return "", fmt.Errorf("WhatsApp Cloud API returned no message id: %s", body)
+	}
+	return response.Messages[0].ID, nil
+}
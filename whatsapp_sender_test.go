@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// whatsappRequest is a request received by the Cloud API stub
+type whatsappRequest struct {
+	path   string
+	header http.Header
+	body   map[string]interface{}
+}
+
+// newWhatsAppStub starts a Cloud API stub answering every request with status and body
+func newWhatsAppStub(t *testing.T, status int, body string) (*httptest.Server, chan whatsappRequest) {
+	t.Helper()
+	requests := make(chan whatsappRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := whatsappRequest{path: r.URL.Path, header: r.Header}
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &request.body); err != nil {
+			t.Errorf("error decoding request body %s: %v", data, err)
+		}
+		requests <- request
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// newTestWhatsAppSender creates a sender for the example templates on the stub
+func newTestWhatsAppSender(t *testing.T, endpoint, countryCode string) *whatsappSender {
+	t.Helper()
+	templates, err := loadWhatsAppTemplates("whatsapp_templates.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := newWhatsAppSender(endpoint, "1234567890", "token", countryCode, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+func TestWhatsAppSenderTemplatePayload(t *testing.T) {
+	server, requests := newWhatsAppStub(t, http.StatusOK, `{"messaging_product": "whatsapp", "messages": [{"id": "wamid.HBgM"}]}`)
+	sender := newTestWhatsAppSender(t, server.URL+"/", "")
+
+	messageID, err := sender.Send(context.Background(), Notification{
+		Event:       "ARN_GENERATED",
+		UserID:      42,
+		PlainMobile: "9876543210",
+		Metadata:    map[string]string{"Name": "Asha", "Arn": "ARN123"},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if messageID != "wamid.HBgM" {
+		t.Errorf("message id = %q, want wamid.HBgM", messageID)
+	}
+
+	request := <-requests
+	if request.path != "/1234567890/messages" {
+		t.Errorf("path = %s, want /1234567890/messages", request.path)
+	}
+	if request.header.Get("Authorization") != "Bearer token" || request.header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers = %v", request.header)
+	}
+	var want map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"messaging_product": "whatsapp",
+		"to": "919876543210",
+		"type": "template",
+		"template": {
+			"name": "arn_generated",
+			"language": {"code": "en"},
+			"components": [
+				{"type": "body", "parameters": [{"type": "text", "text": "Asha"}, {"type": "text", "text": "ARN123"}]},
+				{"type": "button", "sub_type": "url", "index": "0", "parameters": [{"type": "text", "text": "track/ARN123"}]}
+			]
+		}
+	}`), &want)
+	if !reflect.DeepEqual(request.body, want) {
+		t.Errorf("payload = %v, want %v", request.body, want)
+	}
+}
+
+func TestWhatsAppSenderQuickReplyButton(t *testing.T) {
+	server, requests := newWhatsAppStub(t, http.StatusOK, `{"messages": [{"id": "wamid.1"}]}`)
+	sender := newTestWhatsAppSender(t, server.URL, "")
+
+	if _, err := sender.Send(context.Background(), Notification{
+		Event:       "PAN_FORM_DROPOFF",
+		PlainMobile: "9876543210",
+		Metadata:    map[string]string{"Name": "Asha"},
+	}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	components := (<-requests).body["template"].(map[string]interface{})["components"].([]interface{})
+	if len(components) != 3 {
+		t.Fatalf("components = %v, want body, url and quick reply", components)
+	}
+	button := components[2].(map[string]interface{})
+	parameter := button["parameters"].([]interface{})[0].(map[string]interface{})
+	if button["sub_type"] != "quick_reply" || button["index"] != "1" || parameter["type"] != "payload" || parameter["payload"] != "REMIND_LATER:PAN_FORM_DROPOFF" {
+		t.Errorf("quick reply button = %v", button)
+	}
+}
+
+func TestWhatsAppSenderRecipient(t *testing.T) {
+	tests := []struct {
+		countryCode string
+		plainMobile string
+		want        string
+	}{
+		{"", "9876543210", "919876543210"},
+		{"", " +919876543210 ", "919876543210"},
+		{"", "919876543210", "919876543210"},
+		{"971", "5012345678", "9715012345678"},
+	}
+	for _, tt := range tests {
+		sender := newTestWhatsAppSender(t, "http://localhost", tt.countryCode)
+		if got := sender.recipient(tt.plainMobile); got != tt.want {
+			t.Errorf("recipient(%q) with country code %q = %s, want %s", tt.plainMobile, tt.countryCode, got, tt.want)
+		}
+	}
+}
+
+func TestWhatsAppSenderErrors(t *testing.T) {
+	notification := Notification{
+		Event:       "CREDIT_CARD_REJECTED",
+		PlainMobile: "9876543210",
+		Metadata:    map[string]string{"Name": "Asha", "Reasons": "LOW_SCORE"},
+	}
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"API error", http.StatusBadRequest, `{"error": {"message": "(#132001) Template name does not exist", "code": 132001}}`, "status 400: code 132001"},
+		{"unparseable error", http.StatusBadGateway, `<html>Bad Gateway</html>`, "status 502"},
+		{"no message id", http.StatusOK, `{"messages": []}`, "no message id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newWhatsAppStub(t, tt.status, tt.body)
+			sender := newTestWhatsAppSender(t, server.URL, "")
+			_, err := sender.Send(context.Background(), notification)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Send error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Missing metadata fails before calling the API
+	sender := newTestWhatsAppSender(t, "http://localhost:1", "")
+	if _, err := sender.Send(context.Background(), Notification{Event: "CREDIT_CARD_REJECTED", PlainMobile: "9876543210", Metadata: map[string]string{"Name": "Asha"}}); err == nil {
+		t.Error("Send without the Reasons metadata succeeded")
+	}
+}